@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+)
+
+// commandDB is what the maintenance commands need from the database. It is
+// either opened by the command itself, or reached through the admin
+// endpoints of the server that has it open.
+type commandDB interface {
+	CreateSnapshot() (database.SnapshotInfo, error)
+	ListSnapshots() ([]database.SnapshotInfo, error)
+	PruneSnapshots(keep int) ([]database.SnapshotInfo, error)
+	RestoreSnapshot(ctx context.Context, name string) (database.SnapshotInfo, error)
+	ExportUsers(w io.Writer, opts database.TransferOptions) (int, error)
+	ExportChirps(w io.Writer, opts database.TransferOptions) (int, error)
+	Import(ctx context.Context, users io.Reader, chirps io.Reader, opts database.TransferOptions) (database.ImportResult, error)
+	VerifyAudit() (int, error)
+	ApplyRetention(ctx context.Context, now time.Time, dryRun bool) ([]database.RetentionReport, error)
+	Close() error
+}
+
+// adminClient runs commands on a running server through its admin
+// endpoints, logging in with ADMIN_API_KEY. Progress isn't reported, and
+// changes are attributed to admin rather than cli in the audit log.
+type adminClient struct {
+	url    string
+	apiKey string
+}
+
+func newAdminClient(serverURL string) *adminClient {
+	return &adminClient{
+		url:    strings.TrimSuffix(serverURL, "/"),
+		apiKey: os.Getenv("ADMIN_API_KEY"),
+	}
+}
+
+// send makes a request to the server and returns the response if it
+// succeeded. Otherwise the error the server responded with is returned.
+func (c *adminClient) send(method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error reaching the server at %v %v", c.url, err))
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := struct {
+		Error string `json:"error"`
+	}{}
+	if json.Unmarshal(raw, &msg) != nil || msg.Error == "" {
+		msg.Error = strings.TrimSpace(string(raw))
+	}
+	return nil, errors.New(fmt.Sprintf("Server responded with %v: %v", resp.Status, msg.Error))
+}
+
+// do makes a request without a body and decodes the JSON response into out.
+func (c *adminClient) do(method string, path string, out interface{}) error {
+	resp, err := c.send(method, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *adminClient) CreateSnapshot() (database.SnapshotInfo, error) {
+	res := SnapshotResponse{}
+	err := c.do(http.MethodPost, "/admin/snapshots", &res)
+	return res.Snapshot, err
+}
+
+func (c *adminClient) ListSnapshots() ([]database.SnapshotInfo, error) {
+	res := SnapshotsResponse{}
+	err := c.do(http.MethodGet, "/admin/snapshots", &res)
+	return res.Snapshots, err
+}
+
+func (c *adminClient) PruneSnapshots(keep int) ([]database.SnapshotInfo, error) {
+	res := SnapshotsResponse{}
+	err := c.do(http.MethodDelete, fmt.Sprintf("/admin/snapshots?keep=%d", keep), &res)
+	return res.Snapshots, err
+}
+
+func (c *adminClient) RestoreSnapshot(ctx context.Context, name string) (database.SnapshotInfo, error) {
+	res := RestoreResponse{}
+	err := c.do(http.MethodPost, "/admin/snapshots/"+url.PathEscape(name)+"/restore", &res)
+	return res.Undo, err
+}
+
+func (c *adminClient) ExportUsers(w io.Writer, opts database.TransferOptions) (int, error) {
+	return c.export("users", w, opts)
+}
+
+func (c *adminClient) ExportChirps(w io.Writer, opts database.TransferOptions) (int, error) {
+	return c.export("chirps", w, opts)
+}
+
+// export copies the export the server streams to w. The server sends the
+// number of rows in a trailer, once it has written them all.
+func (c *adminClient) export(entity string, w io.Writer, opts database.TransferOptions) (int, error) {
+	params := url.Values{}
+	params.Set("format", string(opts.Format))
+	if opts.IncludePasswords {
+		params.Set("passwords", "true")
+	}
+	resp, err := c.send(http.MethodGet, "/admin/export/"+entity+"?"+params.Encode(), "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := strconv.Atoi(resp.Trailer.Get(exportRowsTrailer))
+	if err != nil {
+		return 0, errors.New("Server did not finish the export")
+	}
+	return rows, nil
+}
+
+// Import uploads the files to the server as a multipart form, streaming
+// them rather than reading them into memory first.
+func (c *adminClient) Import(ctx context.Context, users io.Reader, chirps io.Reader, opts database.TransferOptions) (database.ImportResult, error) {
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		for _, file := range []struct {
+			name string
+			r    io.Reader
+		}{{"users", users}, {"chirps", chirps}} {
+			if file.r == nil {
+				continue
+			}
+			part, err := form.CreateFormFile(file.name, file.name+"."+string(opts.Format))
+			if err == nil {
+				_, err = io.Copy(part, file.r)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(form.Close())
+	}()
+
+	resp, err := c.send(http.MethodPost, "/admin/import?format="+url.QueryEscape(string(opts.Format)), form.FormDataContentType(), body)
+	body.Close()
+	if err != nil {
+		return database.ImportResult{}, err
+	}
+	defer resp.Body.Close()
+	res := ImportResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return database.ImportResult{}, err
+	}
+	return database.ImportResult{Users: res.Users, Chirps: res.Chirps}, nil
+}
+
+func (c *adminClient) VerifyAudit() (int, error) {
+	res := AuditVerifyResponse{}
+	err := c.do(http.MethodGet, "/admin/audit/verify", &res)
+	if err != nil {
+		return 0, err
+	}
+	if !res.Valid {
+		return res.Entries, &database.AuditTamperedError{Seq: res.FirstInvalid}
+	}
+	return res.Entries, nil
+}
+
+// ApplyRetention runs the retention rules on the server, as of the server's
+// clock rather than now.
+func (c *adminClient) ApplyRetention(ctx context.Context, now time.Time, dryRun bool) ([]database.RetentionReport, error) {
+	res := RetentionRunResponse{}
+	err := c.do(http.MethodPost, "/admin/retention/run?dry_run="+strconv.FormatBool(dryRun), &res)
+	return res.Reports, err
+}
+
+func (c *adminClient) Close() error {
+	return nil
+}
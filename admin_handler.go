@@ -1,13 +1,97 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/AtinAgnihotri/chirpy/internal/database"
 	"github.com/go-chi/chi/v5"
 )
 
-func AdminHandler(cfg *ApiConfig) http.Handler {
+type SnapshotResponse struct {
+	Snapshot database.SnapshotInfo `json:"snapshot"`
+}
+
+type SnapshotsResponse struct {
+	Snapshots []database.SnapshotInfo `json:"snapshots"`
+}
+
+type AuditResponse struct {
+	Entries []database.AuditEntry `json:"entries"`
+}
+
+type AuditVerifyResponse struct {
+	Entries int  `json:"entries"`
+	Valid   bool `json:"valid"`
+	// FirstInvalid is the first entry that doesn't hash up, if any.
+	FirstInvalid int `json:"first_invalid,omitempty"`
+}
+
+type RetentionResponse struct {
+	Rules []database.RetentionStats `json:"rules"`
+}
+
+type RetentionRunResponse struct {
+	Reports []database.RetentionReport `json:"reports"`
+}
+
+type HoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+type HoldResponse struct {
+	Hold database.LegalHold `json:"hold"`
+}
+
+type HoldsResponse struct {
+	Holds []database.LegalHold `json:"holds"`
+}
+
+type ImportResponse struct {
+	Users  int `json:"users"`
+	Chirps int `json:"chirps"`
+}
+
+// exportRowsTrailer is the trailer an export sends the number of rows in,
+// once it has written them all.
+const exportRowsTrailer = "X-Export-Rows"
+
+type RestoreResponse struct {
+	Restored string                `json:"restored"`
+	Undo     database.SnapshotInfo `json:"undo"`
+}
+
+// adminAuth only lets requests through that carry ADMIN_API_KEY as an
+// `Authorization: ApiKey <key>` header. Without a key configured, every
+// request is turned away.
+func adminAuth(cfg *ApiConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey, err := GetAuthApiKey(r)
+			if err != nil {
+				log.Printf("error getting admin api key %v", err)
+				RespondWithError(w, http.StatusUnauthorized, "Not Authorized")
+				return
+			}
+			if cfg.AdminApiKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.AdminApiKey)) != 1 {
+				log.Printf("Invalid admin api key")
+				RespondWithError(w, http.StatusUnauthorized, "Not Authorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func AdminHandler(cfg *ApiConfig, db database.Store) http.Handler {
 	r := chi.NewRouter()
 
 	// metrics endpoints
@@ -24,5 +108,349 @@ func AdminHandler(cfg *ApiConfig) http.Handler {
 		return
 	}))
 
+	// snapshot endpoints
+	r.Group(func(r chi.Router) {
+		r.Use(adminAuth(cfg))
+
+		r.Post("/snapshots", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			snapshot, err := db.CreateSnapshot()
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Created snapshot %v", snapshot.Name)
+			RespondWithJSON(w, http.StatusCreated, SnapshotResponse{Snapshot: snapshot})
+		}))
+
+		r.Get("/snapshots", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			snapshots, err := db.ListSnapshots()
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			if snapshots == nil {
+				snapshots = []database.SnapshotInfo{}
+			}
+			RespondWithJSON(w, http.StatusOK, SnapshotsResponse{Snapshots: snapshots})
+		}))
+
+		r.Delete("/snapshots", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keep, err := strconv.Atoi(r.URL.Query().Get("keep"))
+			if err != nil || keep < 0 {
+				RespondWithError(w, http.StatusBadRequest, "Query param keep must be a number of snapshots to keep")
+				return
+			}
+			removed, err := db.PruneSnapshots(keep)
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			if removed == nil {
+				removed = []database.SnapshotInfo{}
+			}
+			log.Printf("Pruned %v snapshots", len(removed))
+			RespondWithJSON(w, http.StatusOK, SnapshotsResponse{Snapshots: removed})
+		}))
+
+		r.Post("/snapshots/{name}/restore", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := chi.URLParam(r, "name")
+			undo, err := db.RestoreSnapshot(RequestActor(r, database.Actor{Name: "admin"}), name)
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Restored snapshot %v, previous data saved as snapshot %v", name, undo.Name)
+			RespondWithJSON(w, http.StatusOK, RestoreResponse{
+				Restored: name,
+				Undo:     undo,
+			})
+		}))
+
+		r.Get("/export/{entity}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			format := database.Format(r.URL.Query().Get("format"))
+			if format == "" {
+				format = database.NDJSON
+			}
+			opts := database.TransferOptions{
+				Format:           format,
+				IncludePasswords: r.URL.Query().Get("passwords") == "true",
+			}
+			if format != database.NDJSON && format != database.CSV {
+				RespondWithError(w, http.StatusBadRequest, "Query param format must be ndjson or csv")
+				return
+			}
+
+			var export func(io.Writer, database.TransferOptions) (int, error)
+			switch chi.URLParam(r, "entity") {
+			case "users":
+				export = db.ExportUsers
+			case "chirps":
+				export = db.ExportChirps
+			default:
+				RespondWithError(w, http.StatusNotFound, "Only users and chirps can be exported")
+				return
+			}
+
+			if format == database.CSV {
+				w.Header().Set("Content-Type", "text/csv")
+			} else {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			w.Header().Set("Trailer", exportRowsTrailer)
+			w.WriteHeader(http.StatusOK)
+			count, err := export(w, opts)
+			if err != nil {
+				log.Printf("Error exporting %v %v", chi.URLParam(r, "entity"), err)
+				return
+			}
+			w.Header().Set(exportRowsTrailer, strconv.Itoa(count))
+			log.Printf("Exported %d %v", count, chi.URLParam(r, "entity"))
+		}))
+
+		r.Post("/import", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			format := database.Format(r.URL.Query().Get("format"))
+			if format == "" {
+				format = database.NDJSON
+			}
+			if format != database.NDJSON && format != database.CSV {
+				RespondWithError(w, http.StatusBadRequest, "Query param format must be ndjson or csv")
+				return
+			}
+			// Large files are spooled to disk rather than kept in memory
+			err := r.ParseMultipartForm(32 << 20)
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, "Request body must be a multipart form with users and chirps files")
+				return
+			}
+			defer r.MultipartForm.RemoveAll()
+
+			readers := map[string]io.Reader{}
+			for _, name := range []string{"users", "chirps"} {
+				files := r.MultipartForm.File[name]
+				if len(files) == 0 {
+					continue
+				}
+				file, err := files[0].Open()
+				if err != nil {
+					log.Printf("Error opening uploaded %v %v", name, err)
+					RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+					return
+				}
+				defer file.Close()
+				readers[name] = file
+			}
+			if len(readers) == 0 {
+				RespondWithError(w, http.StatusBadRequest, "Request body must be a multipart form with users and chirps files")
+				return
+			}
+
+			result, err := db.Import(RequestActor(r, database.Actor{Name: "admin"}), readers["users"], readers["chirps"], database.TransferOptions{Format: format})
+			var importErr *database.ImportError
+			if errors.As(err, &importErr) {
+				RespondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Imported %d users and %d chirps", result.Users, result.Chirps)
+			RespondWithJSON(w, http.StatusOK, ImportResponse{Users: result.Users, Chirps: result.Chirps})
+		}))
+
+		r.Get("/audit", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, err := parseAuditQuery(r)
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			entries, err := db.AuditLog(query)
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			if entries == nil {
+				entries = []database.AuditEntry{}
+			}
+			RespondWithJSON(w, http.StatusOK, AuditResponse{Entries: entries})
+		}))
+
+		r.Get("/audit/verify", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count, err := db.VerifyAudit()
+			var tampered *database.AuditTamperedError
+			if errors.As(err, &tampered) {
+				log.Printf("Audit log verification failed %v", err)
+				RespondWithJSON(w, http.StatusOK, AuditVerifyResponse{Entries: count, FirstInvalid: tampered.Seq})
+				return
+			}
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			RespondWithJSON(w, http.StatusOK, AuditVerifyResponse{Entries: count, Valid: true})
+		}))
+
+		r.Get("/retention", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			RespondWithJSON(w, http.StatusOK, RetentionResponse{Rules: db.RetentionStats()})
+		}))
+
+		r.Post("/retention/run", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dryRun := r.URL.Query().Get("dry_run") == "true"
+			reports, err := db.ApplyRetention(RequestActor(r, database.Actor{Name: "admin"}), time.Now(), dryRun)
+			if err != nil {
+				log.Printf("Error applying retention rules %v", err)
+			}
+			RespondWithJSON(w, http.StatusOK, RetentionRunResponse{Reports: reports})
+		}))
+
+		r.Get("/holds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			holds, err := db.GetHolds()
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			sort.Slice(holds, func(i, j int) bool { return holds[i].PlacedAt.Before(holds[j].PlacedAt) })
+			if holds == nil {
+				holds = []database.LegalHold{}
+			}
+			RespondWithJSON(w, http.StatusOK, HoldsResponse{Holds: holds})
+		}))
+
+		r.Put("/holds/{entity}/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			entity, id, err := parseHoldTarget(r)
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			req := HoldRequest{}
+			err = json.NewDecoder(r.Body).Decode(&req)
+			if err != nil && err != io.EOF {
+				RespondWithError(w, http.StatusBadRequest, "Request body must be a JSON object with a reason")
+				return
+			}
+			hold, err := db.PlaceHold(RequestActor(r, database.Actor{Name: "admin"}), entity, id, req.Reason)
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Placed legal hold on %v %v", entity, id)
+			RespondWithJSON(w, http.StatusOK, HoldResponse{Hold: hold})
+		}))
+
+		r.Delete("/holds/{entity}/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entity, id, err := parseHoldTarget(r)
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			err = db.ReleaseHold(RequestActor(r, database.Actor{Name: "admin"}), entity, id)
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Released legal hold on %v %v", entity, id)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		r.Get("/replication/snapshot", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, seq, err := db.ReplicationSnapshot()
+			if err != nil {
+				RespondWithDBError(w, err)
+				return
+			}
+			log.Printf("Sending replication snapshot at change %v", seq)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}))
+
+		r.Get("/replication/changes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			after, err := strconv.Atoi(r.URL.Query().Get("after"))
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, "Invalid after")
+				return
+			}
+			streamChanges(w, r, db, after)
+		}))
+
+		r.Get("/replication/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.follower == nil {
+				RespondWithJSON(w, http.StatusOK, ReplicationStatus{Role: "leader", AppliedSeq: db.LastChangeSeq()})
+				return
+			}
+			RespondWithJSON(w, http.StatusOK, cfg.follower.Status())
+		}))
+
+		r.Post("/replication/promote", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.follower == nil {
+				RespondWithError(w, http.StatusConflict, "Not a follower")
+				return
+			}
+			err := cfg.follower.promote()
+			if err != nil {
+				RespondWithError(w, http.StatusConflict, err.Error())
+				return
+			}
+			log.Printf("Promoted to leader at change %v", db.LastChangeSeq())
+			RespondWithJSON(w, http.StatusOK, cfg.follower.Status())
+		}))
+	})
+
 	return r
 }
+
+// parseHoldTarget reads the user or chirp a legal hold is placed on from the
+// path params entity (users or chirps) and id.
+func parseHoldTarget(r *http.Request) (string, int, error) {
+	var entity string
+	switch chi.URLParam(r, "entity") {
+	case "users":
+		entity = database.EntityUser
+	case "chirps":
+		entity = database.EntityChirp
+	default:
+		return "", 0, errors.New("Only users and chirps can be held")
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return "", 0, errors.New("Invalid id")
+	}
+	return entity, id, nil
+}
+
+// parseAuditQuery reads the audit log filters from the query params
+// actor_id, actor, entity, since, until (both RFC 3339) and limit.
+func parseAuditQuery(r *http.Request) (database.AuditQuery, error) {
+	params := r.URL.Query()
+	query := database.AuditQuery{
+		Actor:  params.Get("actor"),
+		Entity: params.Get("entity"),
+	}
+	var err error
+	if params.Get("actor_id") != "" {
+		query.ActorID, err = strconv.Atoi(params.Get("actor_id"))
+		if err != nil {
+			return query, errors.New("Query param actor_id must be a user id")
+		}
+	}
+	if params.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil {
+			return query, errors.New("Query param limit must be a number")
+		}
+	}
+	if params.Get("since") != "" {
+		query.Since, err = time.Parse(time.RFC3339, params.Get("since"))
+		if err != nil {
+			return query, errors.New("Query param since must be an RFC 3339 time")
+		}
+	}
+	if params.Get("until") != "" {
+		query.Until, err = time.Parse(time.RFC3339, params.Get("until"))
+		if err != nil {
+			return query, errors.New("Query param until must be an RFC 3339 time")
+		}
+	}
+	return query, nil
+}
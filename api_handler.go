@@ -31,6 +31,17 @@ type keyCfg struct {
 	Key []byte
 }
 
+type SearchResponse struct {
+	Chirps     []database.SearchHit `json:"chirps"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// Page sizes of chirp searches.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
 type PolkaRequest struct {
 	Event string `json:"event"`
 	Data  struct {
@@ -38,10 +49,18 @@ type PolkaRequest struct {
 	} `json:"data"`
 }
 
-func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
+func ApiHandler(cfg *ApiConfig, db database.Store) http.Handler {
 	r := chi.NewRouter()
 	// health endpoint
 	r.Get("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Changes that can't be written to disk would be lost on a restart
+		err := db.FlushError()
+		if err != nil {
+			log.Printf("Unhealthy, error flushing database %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Changes can't be written to disk"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write([]byte("OK"))
@@ -114,13 +133,14 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			return
 		}
 
-		if len(chirp.Body) > 140 {
-			RespondWithError(w, http.StatusBadRequest, "Chirp is too long")
+		body, err := database.CleanChirpBody(chirp.Body)
+		if err != nil {
+			RespondWithDBError(w, err)
 			return
 		}
-		chirpRsc, err := db.CreateChirp(CleanupBody(chirp.Body), userId)
+		chirpRsc, err := db.CreateChirp(RequestActor(r, database.Actor{UserID: userId}), body, userId)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Unable to create a chirp")
+			RespondWithDBError(w, err)
 			return
 		}
 
@@ -173,85 +193,212 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 		param := chi.URLParam(r, "chirpid")
 		chirpId, err := strconv.Atoi(param)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "unable to fetch chirps")
+			RespondWithError(w, http.StatusBadRequest, "Invalid chirp id")
 			return
 		}
 
-		err = db.DeleteChirp(chirpId, userId)
+		err = db.DeleteChirp(RequestActor(r, database.Actor{UserID: userId}), chirpId, userId)
 		if err != nil {
-			message := err.Error()
-			consumerMessage := "Something went wrong"
-			consumerCode := http.StatusInternalServerError
-			if message == "Chirp Author Invalid Authorization" {
-				consumerCode = http.StatusForbidden
-				consumerMessage = message
-			}
-			log.Printf(message)
-			RespondWithError(w, consumerCode, consumerMessage)
+			RespondWithDBError(w, err)
 			return
 		}
 
 		w.WriteHeader(http.StatusOK)
 	}))
 
-	r.Get("/chirps", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		chirps, err := db.GetChirps()
+	r.Get("/chirps/trash", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := GetAccessTokenUserID(r, cfg.JWTSecret)
+		if err != nil {
+			log.Printf("Error authenticating trash request %v", err)
+			RespondWithError(w, http.StatusUnauthorized, "Authorization Rejected")
+			return
+		}
+		chirps, err := db.GetTrash(userId)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "unable to fetch chirps")
+			RespondWithDBError(w, err)
 			return
 		}
-		sortBy := "asc"
-		sortByParam := r.URL.Query().Get("sort")
-		if sortByParam == "desc" {
-			sortBy = sortByParam
+		sort.Slice(chirps, func(i, j int) bool { return chirps[i].DeletedAt.After(*chirps[j].DeletedAt) })
+		if chirps == nil {
+			chirps = []database.ChirpResource{}
 		}
-		fmt.Println("Chirps before sort", len(chirps), sortBy)
-		sort.Slice(chirps, func(p, q int) bool {
-			if sortBy == "desc" {
-				return chirps[p].ID > chirps[q].ID
+		RespondWithJSON(w, http.StatusOK, chirps)
+	}))
+
+	r.Get("/chirps/search", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		limit := defaultSearchLimit
+		if param := params.Get("limit"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 1 || n > maxSearchLimit {
+				RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+				return
 			}
-			return chirps[p].ID < chirps[q].ID
-		})
-		fmt.Println("Chirps after sort", len(chirps))
-		for idx, sl := range chirps {
-			fmt.Println(fmt.Sprintf("%v: %v, %v, %v", idx, sl.AuthorID, sl.ID, sl.Body))
+			limit = n
 		}
-		authorIdParam := r.URL.Query().Get("author_id")
-		if len(authorIdParam) == 0 {
-			RespondWithJSON(w, http.StatusOK, chirps)
+		page, err := db.SearchChirps(params.Get("q"), limit, params.Get("cursor"))
+		if err != nil {
+			RespondWithDBError(w, err)
 			return
 		}
-		authorId, err := strconv.Atoi(authorIdParam)
+		hits := page.Items
+		if hits == nil {
+			hits = []database.SearchHit{}
+		}
+		RespondWithJSON(w, http.StatusOK, SearchResponse{Chirps: hits, NextCursor: page.NextCursor})
+	}))
+
+	r.Post("/chirps/{chirpid}/restore", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := GetAccessTokenUserID(r, cfg.JWTSecret)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			log.Printf("Error authenticating restore request %v", err)
+			RespondWithError(w, http.StatusUnauthorized, "Authorization Rejected")
+			return
+		}
+		chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+			return
+		}
+		chirp, err := db.RestoreChirp(RequestActor(r, database.Actor{UserID: userId}), chirpId, userId)
+		if err != nil {
+			RespondWithDBError(w, err)
 			return
 		}
-		var chirpsForAuthor []database.ChirpResource
-		for _, chirp := range chirps {
-			if chirp.AuthorID == authorId {
-				chirpsForAuthor = append(chirpsForAuthor, chirp)
+		RespondWithJSON(w, http.StatusOK, chirp)
+	}))
+
+	r.Patch("/chirps/{chirpid}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		userId, err := GetAccessTokenUserID(r, cfg.JWTSecret)
+		if err != nil {
+			log.Printf("Error authenticating edit request %v", err)
+			RespondWithError(w, http.StatusUnauthorized, "Authorization Rejected")
+			return
+		}
+		chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+			return
+		}
+		chirp := Chirp{}
+		err = json.NewDecoder(r.Body).Decode(&chirp)
+		if err != nil {
+			log.Printf("Error decoding request body %v", err)
+			RespondWithError(w, http.StatusBadRequest, "Request body must be a JSON object with a body")
+			return
+		}
+		body, err := database.CleanChirpBody(chirp.Body)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		chirpRsc, err := db.EditChirp(RequestActor(r, database.Actor{UserID: userId}), chirpId, userId, body)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		RespondWithJSON(w, http.StatusOK, chirpRsc)
+	}))
+
+	r.Get("/chirps", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		params := r.URL.Query()
+		sortBy := params.Get("sort_by")
+		if sortBy == "" {
+			sortBy = "id"
+		}
+		if !Includes([]string{"id", "created_at", "updated_at"}, sortBy) {
+			RespondWithError(w, http.StatusBadRequest, "sort_by must be id, created_at or updated_at")
+			return
+		}
+		// Chirps created at the same time keep the order of their IDs
+		keys := []string{sortBy}
+		if sortBy != "id" {
+			keys = append(keys, "id")
+		}
+		if params.Get("sort") == "desc" {
+			for idx := range keys {
+				keys[idx] = "-" + keys[idx]
 			}
 		}
-		RespondWithJSON(w, http.StatusOK, chirpsForAuthor)
+		query := database.NewQuery().OrderBy(keys...)
+		authorIdParam := params.Get("author_id")
+		if len(authorIdParam) != 0 {
+			authorId, err := strconv.Atoi(authorIdParam)
+			if err != nil {
+				RespondWithError(w, http.StatusBadRequest, "Invalid author_id")
+				return
+			}
+			query = query.Where("author_id", database.Eq, authorId)
+		}
+		// Time filters are passed on as given, the query checks them
+		for param, filter := range map[string]struct {
+			field string
+			op    database.Op
+		}{
+			"since":         {"created_at", database.Gte},
+			"until":         {"created_at", database.Lte},
+			"updated_since": {"updated_at", database.Gte},
+		} {
+			if value := params.Get(param); value != "" {
+				query = query.Where(filter.field, filter.op, value)
+			}
+		}
+		query, err := PageQuery(r, query)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := db.QueryChirps(query)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		SetNextLink(w, r, page.NextCursor)
+		chirps := page.Items
+		if chirps == nil {
+			chirps = []database.ChirpResource{}
+		}
+		RespondWithJSON(w, http.StatusOK, chirps)
 	}))
 
 	r.Get("/chirps/{chirpid}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		param := chi.URLParam(r, "chirpid")
+		var chirps database.ChirpResource
 		id, err := strconv.Atoi(param)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "unable to fetch chirps")
-			return
+			// Not an integer ID, so try it as a public ID
+			chirps, err = db.GetChirpByPublicID(param)
+		} else {
+			chirps, err = db.GetChirp(id)
 		}
-		chirps, err := db.GetChirp(id)
 		if err != nil {
-			RespondWithError(w, http.StatusNotFound, "unable to fetch chirps")
+			RespondWithDBError(w, err)
 			return
 		}
 		RespondWithJSON(w, http.StatusOK, chirps)
 	}))
 
+	r.Get("/chirps/{chirpid}/revisions", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+			return
+		}
+		revisions, err := db.GetChirpRevisions(chirpId)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		if revisions == nil {
+			revisions = []database.ChirpRevision{}
+		}
+		RespondWithJSON(w, http.StatusOK, revisions)
+	}))
+
 	// Users endpoints
 	r.Post("/users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -265,15 +412,21 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			return
 		}
 
+		email, err := database.NormalizeEmail(user.Email)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		hashBytes, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 		if err != nil {
 			log.Printf("Error decoding request body %v", err)
 			RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 			return
 		}
-		userRsc, err := db.CreateUsers(user.Email, string(hashBytes))
+		userRsc, err := db.CreateUsers(RequestActor(r, database.Actor{Name: "signup"}), email, string(hashBytes))
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Unable to create a user")
+			RespondWithDBError(w, err)
 			return
 		}
 
@@ -283,11 +436,25 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 
 	r.Get("/users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		users, err := db.GetUsers()
+		query := database.NewQuery().OrderBy("id")
+		if r.URL.Query().Get("sort") == "desc" {
+			query = database.NewQuery().OrderBy("-id")
+		}
+		query, err := PageQuery(r, query)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "unable to fetch users")
+			RespondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		page, err := db.QueryUsers(query)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		SetNextLink(w, r, page.NextCursor)
+		users := page.Items
+		if users == nil {
+			users = []database.UserResource{}
+		}
 		RespondWithJSON(w, http.StatusOK, users)
 	}))
 
@@ -296,15 +463,15 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 		param := chi.URLParam(r, "userid")
 		id, err := strconv.Atoi(param)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "unable to fetch users")
+			RespondWithError(w, http.StatusBadRequest, "Invalid user id")
 			return
 		}
-		chirps, err := db.GetChirp(id)
+		user, err := db.GetUser(id)
 		if err != nil {
-			RespondWithError(w, http.StatusNotFound, "unable to fetch users")
+			RespondWithDBError(w, err)
 			return
 		}
-		RespondWithJSON(w, http.StatusOK, chirps)
+		RespondWithJSON(w, http.StatusOK, user)
 	}))
 
 	r.Put("/users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -357,6 +524,11 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			return
 		}
 		user.ID = id
+		user.Email, err = database.NormalizeEmail(user.Email)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		hashedPwd, err := GetHashedPassword(user.Password)
 		if err != nil {
 			log.Printf("Error hashing pwd %v", err)
@@ -365,13 +537,32 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 		}
 		user.Password = hashedPwd
 
-		db.UpdateUsers(user)
+		err = db.UpdateUsers(RequestActor(r, database.Actor{UserID: id}), user)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
 		RespondWithJSON(w, http.StatusOK, database.UserResource{
 			ID:    user.ID,
 			Email: user.Email,
 		})
 	}))
 
+	r.Delete("/users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := GetAccessTokenUserID(r, cfg.JWTSecret)
+		if err != nil {
+			log.Printf("Error authenticating delete user request %v", err)
+			RespondWithError(w, http.StatusUnauthorized, "Authorization Rejected")
+			return
+		}
+		err = db.DeleteUser(RequestActor(r, database.Actor{UserID: userId}), userId)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
 	// login endpoint
 	r.Post("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -384,16 +575,10 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 			return
 		}
-		userMap, err := db.GetUserMapByEmails()
+		usr, err := db.GetUserByEmail(user.Email)
 		if err != nil {
-			log.Printf("Error getting users %v", err)
-			RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
-			return
-		}
-		usr, ok := userMap[user.Email]
-		if !ok {
 			log.Printf("Error getting users data for user %v", user.Email)
-			RespondWithError(w, http.StatusNotFound, fmt.Sprintf("%v user data not found", user.Email))
+			RespondWithDBError(w, err)
 			return
 		}
 
@@ -418,9 +603,12 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 		RespondWithJSON(w, http.StatusOK, database.UserResource{
 			Email:        usr.Email,
 			ID:           usr.ID,
+			PublicID:     usr.PublicID,
 			Token:        accessToken,
 			RefreshToken: refreshToken,
 			IsChirpyRed:  usr.IsChirpyRed,
+			CreatedAt:    usr.CreatedAt,
+			UpdatedAt:    usr.UpdatedAt,
 		})
 
 	}))
@@ -467,15 +655,14 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			return
 		}
 
-		revokedTokens, err := db.GetRevokedTokens()
+		revoked, err := db.IsTokenRevoked(authHeader)
 		if err != nil {
-			log.Printf("Error getting revoked tokens %v", err)
-			RespondWithError(w, http.StatusInternalServerError, "Something Went Wrong")
+			RespondWithDBError(w, err)
 			return
 		}
 
-		if Includes[string](revokedTokens, authHeader) {
-			log.Printf("Invalid issuer recieved")
+		if revoked {
+			log.Printf("Revoked token recieved")
 			RespondWithError(w, http.StatusUnauthorized, "Authorization Rejected")
 			return
 		}
@@ -521,12 +708,23 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			return
 		}
 
-		err = db.RevokeToken(authToken)
-		if err != nil {
-			log.Printf("Error revoking token  %v", err)
+		expiresAt, err := claims.GetExpirationTime()
+		if err != nil || expiresAt == nil {
+			log.Printf("Error getting expiry %v", err)
 			RespondWithError(w, http.StatusInternalServerError, "Something Went Wrong")
 			return
 		}
+
+		actor := database.Actor{}
+		subject, err := claims.GetSubject()
+		if err == nil {
+			actor.UserID, _ = strconv.Atoi(subject)
+		}
+		err = db.RevokeToken(RequestActor(r, actor), authToken, expiresAt.Time)
+		if err != nil {
+			RespondWithDBError(w, err)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -552,24 +750,13 @@ func ApiHandler(cfg *ApiConfig, db *database.DB) http.Handler {
 			RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 			return
 		}
-		fmt.Println("Event", event.Event)
 		if event.Event != "user.upgraded" {
-			fmt.Println("Reaches here 2")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		fmt.Println("Reaches here 3")
-		err = db.MarkUserChirpyRed(event.Data.UserID)
+		err = db.MarkUserChirpyRed(RequestActor(r, database.Actor{Name: "polka"}), event.Data.UserID)
 		if err != nil {
-			log.Printf("error marking user red %v", err)
-			message := err.Error()
-			consumerCode := http.StatusInternalServerError
-			consumerMessage := "Something went wrong"
-			if message == "User Not Found" {
-				consumerCode = http.StatusNotFound
-				consumerMessage = "User Not Found"
-			}
-			RespondWithError(w, consumerCode, consumerMessage)
+			RespondWithDBError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
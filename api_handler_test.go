@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+)
+
+func TestCreateUserEmails(t *testing.T) {
+	db := database.NewMemoryDB(database.Options{})
+	defer db.Close()
+	handler := ApiHandler(&ApiConfig{JWTSecret: "secret"}, db)
+
+	for _, tc := range []struct {
+		email string
+		code  int
+	}{
+		{" A@B.c", http.StatusCreated},
+		{"a@b.C", http.StatusConflict},
+		{"A <d@b.c>", http.StatusBadRequest},
+	} {
+		body := `{"email":"` + tc.email + `","password":"p"}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+		if w.Code != tc.code {
+			t.Fatal(tc.email, w.Code, w.Body.String())
+		}
+		if tc.code != http.StatusCreated {
+			continue
+		}
+		user := database.UserResource{}
+		json.NewDecoder(w.Body).Decode(&user)
+		if user.Email != "a@b.c" {
+			t.Fatal(user)
+		}
+	}
+}
+
+func TestMalformedIDs(t *testing.T) {
+	db := database.NewMemoryDB(database.Options{})
+	defer db.Close()
+	cfg := &ApiConfig{JWTSecret: "secret"}
+	u, _ := db.CreateUsers(context.Background(), "a@b.c", "x")
+	token, err := GenerateAccessToken(u.ID, cfg.JWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ApiHandler(cfg, db)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/users/abc", nil),
+		httptest.NewRequest(http.MethodDelete, "/chirps/abc", nil),
+	} {
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(req.Method, req.URL, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBadChirpQueries(t *testing.T) {
+	db := database.NewMemoryDB(database.Options{})
+	defer db.Close()
+	handler := ApiHandler(&ApiConfig{JWTSecret: "secret"}, db)
+
+	for _, target := range []string{"/chirps?author_id=abc", "/chirps?cursor=garbage"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(target, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+)
+
+// cliContext attributes changes made by commands to the command line in the
+// audit log.
+var cliContext = database.WithActor(context.Background(), database.Actor{Name: "cli"})
+
+// runCommand runs one of the maintenance commands that can be given after
+// the flags instead of starting the server, e.g. `./out rotate-key`.
+func runCommand(args []string, flags serverFlags, encryptionKey []byte) error {
+	// --debug wipes the database on open, which is never what a command wants
+	if flags.debug {
+		return errors.New("--debug only applies to the server, run commands without it")
+	}
+	switch args[0] {
+	case "rotate-key":
+		return rotateKey(flags, encryptionKey)
+	case "snapshot":
+		return snapshot(args[1:], flags, encryptionKey)
+	case "export":
+		return export(args[1:], flags, encryptionKey)
+	case "import":
+		return importData(args[1:], flags, encryptionKey)
+	case "verify-audit":
+		return verifyAudit(flags, encryptionKey)
+	case "retention":
+		return retention(args[1:], flags, encryptionKey)
+	case "promote":
+		return promote(args[1:])
+	}
+	return errors.New(fmt.Sprintf("Unknown command %v", args[0]))
+}
+
+// openCommandDB opens db.json for a command. If a running server has it
+// open, the command is run on that server through its admin endpoints
+// instead, which it is reached at on --port.
+func openCommandDB(flags serverFlags, encryptionKey []byte) (commandDB, error) {
+	db, err := database.NewDB(flags.dbPath, dbOptions(flags, encryptionKey))
+	var locked *database.LockedError
+	if errors.As(err, &locked) {
+		client := newAdminClient("http://localhost:" + flags.port)
+		log.Printf("%v, running the command on the server at %v", err, client.url)
+		return client, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// rotateKey re-encrypts db.json and its backups from DB_ENCRYPTION_KEY to
+// DB_ENCRYPTION_KEY_NEW. Either can be left empty to go from or to
+// plaintext.
+func rotateKey(flags serverFlags, encryptionKey []byte) error {
+	newKey, err := database.ParseEncryptionKey(os.Getenv("DB_ENCRYPTION_KEY_NEW"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading DB_ENCRYPTION_KEY_NEW %v", err))
+	}
+
+	db, err := database.NewDB(flags.dbPath, dbOptions(flags, encryptionKey))
+	var locked *database.LockedError
+	if errors.As(err, &locked) {
+		return errors.New(fmt.Sprintf("%v, stop it before rotating the key", err))
+	}
+	if err != nil {
+		return err
+	}
+	err = db.RotateKey(newKey)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+
+	if newKey == nil {
+		log.Printf("Database decrypted, remove DB_ENCRYPTION_KEY from .env")
+		return nil
+	}
+	log.Printf("Database re-encrypted, set DB_ENCRYPTION_KEY to the value of DB_ENCRYPTION_KEY_NEW in .env")
+	return nil
+}
+
+const snapshotUsage = "Usage: snapshot create | list | prune <keep> | restore <name>"
+
+// snapshot creates, lists, prunes or restores snapshots of db.json.
+func snapshot(args []string, flags serverFlags, encryptionKey []byte) error {
+	if len(args) == 0 {
+		return errors.New(snapshotUsage)
+	}
+	var keep int
+	var err error
+	switch args[0] {
+	case "create", "list":
+	case "prune":
+		if len(args) != 2 {
+			return errors.New(snapshotUsage)
+		}
+		keep, err = strconv.Atoi(args[1])
+		if err != nil || keep < 0 {
+			return errors.New(fmt.Sprintf("Invalid number of snapshots to keep %v", args[1]))
+		}
+	case "restore":
+		if len(args) != 2 {
+			return errors.New(snapshotUsage)
+		}
+	default:
+		return errors.New(snapshotUsage)
+	}
+
+	db, err := openCommandDB(flags, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		snapshot, err := db.CreateSnapshot()
+		if err != nil {
+			return err
+		}
+		log.Printf("Created snapshot %v", snapshot.Name)
+	case "list":
+		snapshots, err := db.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			log.Printf("No snapshots found")
+		}
+		for _, snapshot := range snapshots {
+			fmt.Printf("%v\t%v\t%d bytes\n", snapshot.Name, snapshot.CreatedAt.Format(time.RFC3339), snapshot.Size)
+		}
+	case "prune":
+		removed, err := db.PruneSnapshots(keep)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range removed {
+			log.Printf("Removed snapshot %v", snapshot.Name)
+		}
+	case "restore":
+		undo, err := db.RestoreSnapshot(cliContext, args[1])
+		if err != nil {
+			return err
+		}
+		log.Printf("Restored snapshot %v, previous data saved as snapshot %v", args[1], undo.Name)
+	}
+	return db.Close()
+}
+
+// logProgress logs how far along an import or export is. sizes holds the
+// size of the file each entity is read from, and is empty when writing.
+func logProgress(verb string, sizes map[string]int64) func(database.Progress) {
+	return func(p database.Progress) {
+		if size := sizes[p.Entity]; size > 0 {
+			log.Printf("%v %d %vs (%d%%)", verb, p.Rows, p.Entity, min(p.Bytes*100/size, 100))
+			return
+		}
+		log.Printf("%v %d %vs", verb, p.Rows, p.Entity)
+	}
+}
+
+// export writes users and chirps out to NDJSON or CSV files, picking the
+// format from each file's extension, e.g.
+// `./out export --users=users.csv --chirps=chirps.ndjson`.
+func export(args []string, flags serverFlags, encryptionKey []byte) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	usersPath := fs.String("users", "", "File to export users to")
+	chirpsPath := fs.String("chirps", "", "File to export chirps to")
+	withPasswords := fs.Bool("with-passwords", false, "Include password hashes in the exported users")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *usersPath == "" && *chirpsPath == "" {
+		return errors.New("Usage: export [--users=<file>] [--chirps=<file>] [--with-passwords]")
+	}
+
+	db, err := openCommandDB(flags, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exports := []struct {
+		path string
+		fn   func(io.Writer, database.TransferOptions) (int, error)
+	}{
+		{*usersPath, db.ExportUsers},
+		{*chirpsPath, db.ExportChirps},
+	}
+	for _, e := range exports {
+		if e.path == "" {
+			continue
+		}
+		format, err := database.FormatFromPath(e.path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(e.path)
+		if err != nil {
+			return err
+		}
+		count, err := e.fn(file, database.TransferOptions{
+			Format:           format,
+			IncludePasswords: *withPasswords,
+			Progress:         logProgress("Exported", nil),
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+		log.Printf("Wrote %d rows to %v", count, e.path)
+	}
+	return db.Close()
+}
+
+// importData adds users and chirps from NDJSON or CSV files, picking the
+// format from each file's extension, e.g.
+// `./out import --users=users.csv --chirps=chirps.ndjson`.
+func importData(args []string, flags serverFlags, encryptionKey []byte) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	usersPath := fs.String("users", "", "File to import users from")
+	chirpsPath := fs.String("chirps", "", "File to import chirps from")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *usersPath == "" && *chirpsPath == "" {
+		return errors.New("Usage: import [--users=<file>] [--chirps=<file>]")
+	}
+
+	var format database.Format
+	sizes := map[string]int64{}
+	readers := map[string]io.Reader{}
+	for entity, path := range map[string]string{"user": *usersPath, "chirp": *chirpsPath} {
+		if path == "" {
+			continue
+		}
+		pathFormat, err := database.FormatFromPath(path)
+		if err != nil {
+			return err
+		}
+		if format != "" && pathFormat != format {
+			return errors.New("Users and chirps must be imported from files of the same format")
+		}
+		format = pathFormat
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		sizes[entity] = info.Size()
+		readers[entity] = file
+	}
+
+	db, err := openCommandDB(flags, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := db.Import(cliContext, readers["user"], readers["chirp"], database.TransferOptions{
+		Format:   format,
+		Progress: logProgress("Imported", sizes),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d users and %d chirps", result.Users, result.Chirps)
+	return db.Close()
+}
+
+// verifyAudit checks that the audit log has not been tampered with.
+func verifyAudit(flags serverFlags, encryptionKey []byte) error {
+	db, err := openCommandDB(flags, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	count, err := db.VerifyAudit()
+	if err != nil {
+		return err
+	}
+	log.Printf("Audit log is intact, %d entries", count)
+	return db.Close()
+}
+
+// retention applies the retention rules once, reporting what each of them
+// purged. With --dry-run it only reports what they would purge.
+func retention(args []string, flags serverFlags, encryptionKey []byte) error {
+	fs := flag.NewFlagSet("retention", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be purged")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openCommandDB(flags, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reports, err := db.ApplyRetention(cliContext, time.Now(), *dryRun)
+	for _, report := range reports {
+		verb := "Purged"
+		if report.DryRun {
+			verb = "Would purge"
+		}
+		fmt.Printf("%v (%v)\t%v %d\t%d held\n", report.Rule, report.MaxAge, verb, report.Purged, report.Held)
+		for _, key := range report.Keys {
+			fmt.Printf("\t%v\n", key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// promote turns the follower running at the given URL into a leader, using
+// ADMIN_API_KEY to log in to it.
+func promote(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: promote <follower url>")
+	}
+	status := ReplicationStatus{}
+	err := newAdminClient(args[0]).do(http.MethodPost, "/admin/replication/promote", &status)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Promote failed %v", err))
+	}
+	log.Printf("Promoted %v to leader at change %v", args[0], status.AppliedSeq)
+	return nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -41,25 +48,80 @@ func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) error
 	return nil
 }
 
-func IsBannedWord(token string) bool {
-	banned := []string{"kerfuffle", "sharbert", "fornax"}
-	for _, b := range banned {
-		if strings.ToLower(token) == b {
-			return true
-		}
+// RespondWithDBError responds with the status code matching an error from
+// the database package, so every endpoint reports them the same way. Only
+// errors the caller caused have their message passed on.
+func RespondWithDBError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return RespondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrForbidden):
+		return RespondWithError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, database.ErrConflict):
+		return RespondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, database.ErrInvalid):
+		return RespondWithError(w, http.StatusBadRequest, err.Error())
 	}
-	return false
+	log.Printf("Database error %v", err)
+	return RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 }
 
-func CleanupBody(body string) string {
-	clean := strings.TrimSpace(body)
-	tokens := strings.Split(body, " ")
-	for _, token := range tokens {
-		if IsBannedWord(token) {
-			clean = strings.Replace(clean, token, "****", 1)
+// RequestActor returns the context of r, attributing database changes made
+// with it to actor, along with the ID and client IP of the request.
+func RequestActor(r *http.Request, actor database.Actor) context.Context {
+	actor.RequestID = middleware.GetReqID(r.Context())
+	actor.IP = r.RemoteAddr
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		actor.IP = host
+	}
+	return database.WithActor(r.Context(), actor)
+}
+
+// Page sizes of the list endpoints.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// PageQuery adds the paging query params of a list endpoint to q: limit,
+// cursor (the next cursor of the previous page), since_id (only IDs above
+// it) and max_id (only IDs up to and including it).
+func PageQuery(r *http.Request, q database.Query) (database.Query, error) {
+	params := r.URL.Query()
+	limit := defaultPageLimit
+	if param := params.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	q = q.Limit(limit)
+	if cursor := params.Get("cursor"); cursor != "" {
+		q = q.After(cursor)
+	}
+	for param, op := range map[string]database.Op{"since_id": database.Gt, "max_id": database.Lte} {
+		if value := params.Get(param); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return q, fmt.Errorf("Invalid %v", param)
+			}
+			q = q.Where("id", op, id)
 		}
 	}
-	return clean
+	return q, nil
+}
+
+// SetNextLink points a Link header at the next page of r, if there is one.
+func SetNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	params := r.URL.Query()
+	params.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: params.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, next.String()))
 }
 
 func GetHashedPassword(pwd string) (string, error) {
@@ -119,3 +181,28 @@ func GetAuthBearer(r *http.Request) (string, error) {
 func GetAuthApiKey(r *http.Request) (string, error) {
 	return getAuthToken(r, "ApiKey ")
 }
+
+// GetAccessTokenUserID returns the ID of the user whose access token r
+// carries as its bearer token.
+func GetAccessTokenUserID(r *http.Request, jwtSecret string) (int, error) {
+	authToken, err := GetAuthBearer(r)
+	if err != nil {
+		return 0, err
+	}
+	claims, err := GetJWTClaims(authToken, jwtSecret)
+	if err != nil {
+		return 0, err
+	}
+	issuer, err := claims.GetIssuer()
+	if err != nil {
+		return 0, err
+	}
+	if issuer != "chirpy-access" {
+		return 0, errors.New("Not an access token")
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(subject)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+)
+
+func TestRespondWithDBError(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDB(database.Options{})
+	u, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	c, _ := db.CreateChirp(ctx, "hi", u.ID)
+
+	_, notFound := db.GetChirp(99)
+	forbidden := db.DeleteChirp(ctx, c.ID, u.ID+1)
+	_, conflict := db.CreateUsers(ctx, "a@b.c", "h")
+	_, invalid := database.NormalizeEmail("nope")
+	db.Close()
+	_, closed := db.CreateUsers(ctx, "d@b.c", "h")
+
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{notFound, http.StatusNotFound},
+		{forbidden, http.StatusForbidden},
+		{conflict, http.StatusConflict},
+		{invalid, http.StatusBadRequest},
+		{closed, http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		RespondWithDBError(w, tc.err)
+		if w.Code != tc.code {
+			t.Fatal(tc.err, w.Code)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Actor is whoever a mutation is made on behalf of. UserID is set for
+// requests made by a logged in user, Name for everything else, e.g. "polka"
+// or "cli".
+type Actor struct {
+	UserID    int    `json:"user_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+}
+
+type actorKey struct{}
+
+// systemContext attributes mutations to the database's own background work.
+var systemContext = WithActor(context.Background(), Actor{Name: "system"})
+
+// WithActor returns a copy of ctx that attributes mutations made with it to
+// actor in the audit log.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set on ctx with WithActor, if any.
+func ActorFrom(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// AuditEntry records one mutation. Entries form a hash chain: Hash covers
+// the entry itself and PrevHash, the Hash of the entry before it, so an entry
+// can't be altered, removed or reordered without breaking every Hash after
+// it.
+type AuditEntry struct {
+	Seq      int           `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"`
+	Actor    Actor         `json:"actor"`
+	Note     string        `json:"note,omitempty"`
+	Changes  []AuditChange `json:"changes,omitempty"`
+	PrevHash string        `json:"prev_hash"`
+	Hash     string        `json:"hash"`
+}
+
+// AuditChange is a single row a mutation changed. ChangeSeq is the Seq of
+// the matching change Event. Fields lists what an update changed, with
+// password hashes redacted.
+type AuditChange struct {
+	ChangeSeq int                    `json:"change_seq"`
+	Entity    string                 `json:"entity"`
+	Op        string                 `json:"op"`
+	Key       string                 `json:"key"`
+	Fields    map[string]FieldChange `json:"fields,omitempty"`
+}
+
+type FieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+var redactedFields = map[string]bool{"password": true}
+
+var redacted = json.RawMessage(`"[redacted]"`)
+
+// AuditTamperedError is returned when the audit log does not hash up.
+type AuditTamperedError struct {
+	Seq int
+}
+
+func (e *AuditTamperedError) Error() string {
+	return fmt.Sprintf("Audit log has been tampered with at entry %v", e.Seq)
+}
+
+// auditChain is the end of the audit log that the next entry is chained to.
+type auditChain struct {
+	seq  int
+	hash string
+}
+
+// hashEntry returns the hash entry should carry.
+func hashEntry(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(entry.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// audit chains a new entry for action onto the log. The caller must hold the
+// write lock.
+func (db *DB) audit(ctx context.Context, action string, note string, events []Event, now time.Time) error {
+	entry := AuditEntry{
+		Seq:      db.chain.seq + 1,
+		Time:     now,
+		Action:   action,
+		Actor:    ActorFrom(ctx),
+		Note:     note,
+		PrevHash: db.chain.hash,
+	}
+	for _, event := range events {
+		change := AuditChange{ChangeSeq: event.Seq, Entity: event.Entity, Op: event.Op, Key: event.Key}
+		if event.Op == OpUpdate {
+			fields, err := diffFields(event.Before, event.After)
+			if err != nil {
+				return err
+			}
+			change.Fields = fields
+		}
+		entry.Changes = append(entry.Changes, change)
+	}
+	hash, err := hashEntry(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	db.chain = auditChain{seq: entry.Seq, hash: hash}
+	db.pendingAudit = append(db.pendingAudit, entry)
+	return nil
+}
+
+// diffFields compares two JSON objects field by field.
+func diffFields(before, after json.RawMessage) (map[string]FieldChange, error) {
+	var from, to map[string]json.RawMessage
+	err := json.Unmarshal(before, &from)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(after, &to)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]FieldChange{}
+	for name, value := range to {
+		if bytes.Equal(from[name], value) {
+			continue
+		}
+		if redactedFields[name] {
+			fields[name] = FieldChange{From: redacted, To: redacted}
+			continue
+		}
+		fields[name] = FieldChange{From: from[name], To: value}
+	}
+	for name, value := range from {
+		if _, ok := to[name]; !ok {
+			fields[name] = FieldChange{From: value, To: json.RawMessage("null")}
+		}
+	}
+	return fields, nil
+}
+
+// AuditQuery filters the audit log. Zero values match everything.
+type AuditQuery struct {
+	ActorID int
+	Actor   string
+	Entity  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	if q.ActorID != 0 && entry.Actor.UserID != q.ActorID {
+		return false
+	}
+	if q.Actor != "" && entry.Actor.Name != q.Actor {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !entry.Time.Before(q.Until) {
+		return false
+	}
+	if q.Entity == "" {
+		return true
+	}
+	for _, change := range entry.Changes {
+		if change.Entity == q.Entity {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog returns the entries matching q, newest first and at most
+// q.Limit of them (100 if not set).
+func (db *DB) AuditLog(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	var entries []AuditEntry
+	err := db.readAudit(func(entry AuditEntry) error {
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+// VerifyAudit walks the whole audit log checking that every entry hashes
+// up and follows the one before it. It returns how many entries there are,
+// or an *AuditTamperedError pointing at the first one that doesn't.
+func (db *DB) VerifyAudit() (int, error) {
+	chain := auditChain{}
+	err := db.readAudit(func(entry AuditEntry) error {
+		hash, err := hashEntry(entry)
+		if err != nil {
+			return err
+		}
+		if entry.Seq != chain.seq+1 || entry.PrevHash != chain.hash || entry.Hash != hash {
+			return &AuditTamperedError{Seq: chain.seq + 1}
+		}
+		chain = auditChain{seq: entry.Seq, hash: entry.Hash}
+		return nil
+	})
+	return chain.seq, err
+}
+
+// readAudit calls fn with every audit entry, oldest first, including the
+// ones that have not been written out yet.
+func (db *DB) readAudit(fn func(AuditEntry) error) error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	err := db.store.readAudit(fn)
+	if err != nil {
+		return err
+	}
+	db.mux.RLock()
+	pending := append([]AuditEntry(nil), db.pendingAudit...)
+	db.mux.RUnlock()
+	for _, entry := range pending {
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastAuditEntry returns the end of the audit log persisted by store.
+func lastAuditEntry(store backend) (auditChain, error) {
+	chain := auditChain{}
+	err := store.readAudit(func(entry AuditEntry) error {
+		chain = auditChain{seq: entry.Seq, hash: entry.Hash}
+		return nil
+	})
+	return chain, err
+}
+
+// appendAudit writes entries to the end of the audit log at path.
+func appendAudit(path string, entries []AuditEntry, s *sealer) error {
+	data, err := encodeAudit(entries, s)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeAuditFile replaces the audit log at path with entries, which is only
+// done to re-encrypt it.
+func writeAuditFile(path string, entries []AuditEntry, s *sealer) error {
+	data, err := encodeAudit(entries, s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func encodeAudit(entries []AuditEntry, s *sealer) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, entry := range entries {
+		line, err := encodeLine(entry, s)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// readAuditFile calls fn with every entry in the audit log at path. A
+// half-written last line is ignored, like in the WAL.
+func readAuditFile(path string, s *sealer, fn func(AuditEntry) error) error {
+	lines, err := readLogLines(path)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		entry := AuditEntry{}
+		err := decodeLine(line, s, &entry)
+		if errors.Is(err, ErrNoKey) || errors.Is(err, ErrWrongKey) {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	actx := WithActor(ctx, Actor{UserID: 1, RequestID: "r1", IP: "1.2.3.4"})
+	u, _ := db.CreateUsers(WithActor(ctx, Actor{Name: "signup"}), "a@b.c", "h")
+	c, _ := db.CreateChirp(actx, "hi", u.ID)
+	db.UpdateUsers(actx, DetailedUserResource{ID: u.ID, Email: "new@b.c", Password: "h2"})
+	// Forbidden, so nothing changes and nothing is audited
+	db.DeleteChirp(actx, c.ID, 2)
+	db.DeleteChirp(actx, c.ID, u.ID)
+
+	entries, err := db.AuditLog(AuditQuery{ActorID: 1})
+	if err != nil || len(entries) != 3 || entries[0].Action != "DeleteChirp" || entries[0].Seq != 4 {
+		t.Fatalf("%+v %v", entries, err)
+	}
+	fields := entries[1].Changes[0].Fields
+	if string(fields["email"].To) != `"new@b.c"` || string(fields["password"].To) != `"[redacted]"` {
+		t.Fatalf("%+v", fields)
+	}
+	if entries, _ := db.AuditLog(AuditQuery{Entity: "user"}); len(entries) != 2 {
+		t.Fatal(entries)
+	}
+	if entries, _ := db.AuditLog(AuditQuery{Since: time.Now().Add(time.Hour)}); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	if n, err := db.VerifyAudit(); n != 4 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestAuditTampering(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	db, err := NewDB(path, Options{FlushEvery: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	db.UpdateUsers(ctx, DetailedUserResource{ID: u.ID, Email: "new@b.c", Password: "h"})
+	db.CreateChirp(ctx, "hi", u.ID)
+	db.Close()
+
+	raw, err := os.ReadFile(path + ".audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(raw, []byte("new@b.c"), []byte("evil@b.c"), 1)
+	if bytes.Equal(raw, tampered) {
+		t.Fatal("update not found in the audit log")
+	}
+	os.WriteFile(path+".audit", tampered, 0600)
+
+	db, err = NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var tamperedErr *AuditTamperedError
+	if _, err := db.VerifyAudit(); !errors.As(err, &tamperedErr) || tamperedErr.Seq != 2 {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditAppendAfterTornEntry(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	opts := Options{FlushEvery: 1}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	db.Close()
+
+	// A crash while appending leaves half an entry behind, which is damage
+	// rather than tampering
+	f, err := os.OpenFile(path+".audit", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"action":"Crea`)
+	f.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp(ctx, "hi", u.ID)
+	db.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n, err := db.VerifyAudit(); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,473 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backend is where DB reads and writes its data from. Locking between
+// goroutines is handled by DB, backends only need to persist DBData.
+// write receives both the full resulting data and the records that produced
+// it, so a backend can choose to persist either.
+// compact replaces everything persisted with dbData, and backup keeps a copy
+// of what is currently persisted under the given label. Change events are
+// kept apart from the data, so consumers can catch up on them; only the
+// newest are kept. The audit log is only ever appended to. close releases
+// anything the backend holds on to, after which it can't be used.
+type backend interface {
+	load() (DBData, error)
+	write(dbData DBData, records []record) error
+	compact(dbData DBData) error
+	backup(label string) error
+	loadChanges() ([]Event, error)
+	appendChanges(events []Event) error
+	resetChanges() error
+	appendAudit(entries []AuditEntry) error
+	readAudit(fn func(AuditEntry) error) error
+	close() error
+}
+
+// walCompactThreshold is how many log records the JSON file backend collects
+// before folding them into a fresh snapshot.
+const walCompactThreshold = 1000
+
+func emptyDBData() DBData {
+	return DBData{
+		SchemaVersion: SchemaVersion(),
+		Chirps:        map[int]ChirpResource{},
+		Users:         map[int]DetailedUserResource{},
+		Revocations:   map[string]Revocation{},
+		Holds:         map[string]LegalHold{},
+		Revisions:     map[int]ChirpHistory{},
+		Sequences:     map[string]int{},
+	}
+}
+
+// jsonFileBackend keeps a JSON snapshot of DBData on disk, plus an
+// append-only log of every mutation made since that snapshot was taken.
+// Every snapshot written is also kept as a backup, up to the newest backups
+// of them. The files are locked against other processes for as long as the
+// backend is open, and encrypted if sealer is set.
+type jsonFileBackend struct {
+	path         string
+	walPath      string
+	walRecords   int
+	changesPath  string
+	changesKeep  int
+	changesCount int
+	auditPath    string
+	backups      int
+	recover      bool
+	lock         *fileLock
+	sealer       *sealer
+}
+
+func newJSONFileBackend(path string, opts Options) (*jsonFileBackend, error) {
+	s, err := newSealer(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFileWithin(path+".lock", true, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	changesKeep := opts.ChangeLogSize
+	if changesKeep <= 0 {
+		changesKeep = defaultChangeLogSize
+	}
+	b := &jsonFileBackend{
+		path:        path,
+		walPath:     path + ".wal",
+		changesPath: path + ".changes",
+		changesKeep: changesKeep,
+		auditPath:   path + ".audit",
+		backups:     opts.Backups,
+		recover:     opts.RecoverFromBackup,
+		lock:        lock,
+		sealer:      s,
+	}
+	if opts.Debug {
+		err = b.cleanup()
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	err = b.ensure()
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	// The audit log is only ever appended to, so a line a crash left
+	// half-written has to go before the next entry runs on from it
+	err = repairLog(b.auditPath)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *jsonFileBackend) close() error {
+	return b.lock.unlock()
+}
+
+func (b *jsonFileBackend) cleanup() error {
+	err := os.Remove(b.path)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{b.walPath, b.changesPath, b.auditPath} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensure creates an empty snapshot if none exists yet, and folds any log
+// left over from the last run into the snapshot. A corrupt snapshot is
+// replaced by the newest valid backup if recover is set, and a plaintext
+// one is encrypted right away if a key was given.
+func (b *jsonFileBackend) ensure() error {
+	_, err := os.Stat(b.path)
+	if os.IsNotExist(err) {
+		return b.writeSnapshot(emptyDBData())
+	}
+	if err != nil {
+		return err
+	}
+
+	dbData, count, encrypted, err := b.read()
+	var corruptErr *CorruptError
+	if errors.As(err, &corruptErr) {
+		dbData, count, encrypted, err = b.recoverFromBackup(corruptErr)
+	}
+	if err != nil {
+		return err
+	}
+	if b.sealer != nil && !encrypted {
+		log.Printf("Encrypting %v along with its backups and snapshots", b.path)
+		return b.reencrypt(dbData, nil, b.sealer)
+	}
+	if count == 0 {
+		// Nothing to fold in, but a crash may have left half a line behind
+		// that the next append would run on from
+		return repairLog(b.walPath)
+	}
+	return b.compact(dbData)
+}
+
+func (b *jsonFileBackend) load() (DBData, error) {
+	dbData, _, _, err := b.read()
+	return dbData, err
+}
+
+// read loads the snapshot and replays the log on top of it, returning how
+// many log records were replayed and whether the snapshot was encrypted.
+func (b *jsonFileBackend) read() (DBData, int, bool, error) {
+	dbData, encrypted, err := readSnapshot(b.path, b.sealer)
+	if err != nil {
+		return dbData, 0, encrypted, err
+	}
+	count, err := replayWAL(b.walPath, &dbData, b.sealer)
+	if err != nil {
+		return dbData, count, encrypted, err
+	}
+	return dbData, count, encrypted, nil
+}
+
+func (b *jsonFileBackend) recoverFromBackup(corruptErr *CorruptError) (DBData, int, bool, error) {
+	backup, err := newestValidBackup(b.path, b.sealer)
+	if err != nil {
+		return DBData{}, 0, false, err
+	}
+	corruptErr.Backup = backup
+	if backup == "" || !b.recover {
+		return DBData{}, 0, false, corruptErr
+	}
+
+	log.Printf("Recovering corrupt %v from backup %v", b.path, backup)
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return DBData{}, 0, false, err
+	}
+	err = writeFileAtomic(b.path, data)
+	if err != nil {
+		return DBData{}, 0, false, err
+	}
+	return b.read()
+}
+
+func (b *jsonFileBackend) write(dbData DBData, records []record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	err := appendWAL(b.walPath, records, b.sealer)
+	if err != nil {
+		return err
+	}
+	b.walRecords += len(records)
+	if b.walRecords < walCompactThreshold {
+		return nil
+	}
+	return b.compact(dbData)
+}
+
+// compact writes dbData out as the new snapshot and empties the log.
+func (b *jsonFileBackend) compact(dbData DBData) error {
+	err := b.writeSnapshot(dbData)
+	if err != nil {
+		return err
+	}
+	err = os.Truncate(b.walPath, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b.walRecords = 0
+	return nil
+}
+
+func (b *jsonFileBackend) backup(label string) error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("%v.%v.%d", b.path, label, time.Now().UTC().UnixNano()), data)
+}
+
+// loadChanges returns the newest changesKeep events, after cutting off a
+// line a crash left half-written, so the next append starts cleanly.
+func (b *jsonFileBackend) loadChanges() ([]Event, error) {
+	err := repairLog(b.changesPath)
+	if err != nil {
+		return nil, err
+	}
+	events, err := readChanges(b.changesPath, b.changesKeep, b.sealer)
+	b.changesCount = len(events)
+	return events, err
+}
+
+// appendChanges adds events to the change log, and cuts it back down to the
+// newest changesKeep once it has grown to twice that.
+func (b *jsonFileBackend) appendChanges(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	err := appendChanges(b.changesPath, events, b.sealer)
+	if err != nil {
+		return err
+	}
+	b.changesCount += len(events)
+	if b.changesCount < 2*b.changesKeep {
+		return nil
+	}
+	kept, err := b.loadChanges()
+	if err != nil {
+		return err
+	}
+	return writeChanges(b.changesPath, kept, b.sealer)
+}
+
+func (b *jsonFileBackend) resetChanges() error {
+	b.changesCount = 0
+	return writeChanges(b.changesPath, nil, b.sealer)
+}
+
+func (b *jsonFileBackend) appendAudit(entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return appendAudit(b.auditPath, entries, b.sealer)
+}
+
+func (b *jsonFileBackend) readAudit(fn func(AuditEntry) error) error {
+	return readAuditFile(b.auditPath, b.sealer, fn)
+}
+
+func (b *jsonFileBackend) writeSnapshot(dbData DBData) error {
+	data, err := encodeSnapshot(dbData, b.sealer)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(b.path, data)
+	if err != nil {
+		return err
+	}
+	if b.backups <= 0 {
+		return nil
+	}
+	return writeBackup(b.path, data, b.backups)
+}
+
+// reencrypt switches the backend over to the to key, writing dbData out as a
+// fresh snapshot and rewriting every backup and every snapshot in the
+// snapshot directory that is still under the from key. Either key can be nil
+// for plaintext.
+func (b *jsonFileBackend) reencrypt(dbData DBData, from, to *sealer) error {
+	events, err := readChanges(b.changesPath, b.changesKeep, from)
+	if err != nil {
+		return err
+	}
+	var entries []AuditEntry
+	err = readAuditFile(b.auditPath, from, func(entry AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.sealer = to
+	err = b.compact(dbData)
+	if err != nil {
+		return err
+	}
+	err = writeChanges(b.changesPath, events, to)
+	if err != nil {
+		return err
+	}
+	b.changesCount = len(events)
+	if len(entries) > 0 {
+		err = writeAuditFile(b.auditPath, entries, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	backups, err := listBackups(b.path)
+	if err != nil {
+		return err
+	}
+	labelled, err := filepath.Glob(b.path + ".pre-migration-*")
+	if err != nil {
+		return err
+	}
+	snapshots, err := filepath.Glob(filepath.Join(b.snapshotDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	copies := append(append(backups, labelled...), snapshots...)
+	for _, path := range copies {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, _, err = decodeSnapshot(raw, to)
+		if err == nil {
+			continue
+		}
+		backupData, _, err := decodeSnapshot(raw, from)
+		if err != nil {
+			log.Printf("Skipping unreadable copy %v %v", path, err)
+			continue
+		}
+		data, err := encodeSnapshot(backupData, to)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(path, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryBackend never touches disk. DB already keeps its data in memory, so
+// there is nothing for it to load or persist, except for the audit log.
+type memoryBackend struct {
+	audit []AuditEntry
+}
+
+func (memoryBackend) load() (DBData, error) {
+	return emptyDBData(), nil
+}
+
+func (memoryBackend) write(dbData DBData, records []record) error {
+	return nil
+}
+
+func (memoryBackend) compact(dbData DBData) error {
+	return nil
+}
+
+func (memoryBackend) backup(label string) error {
+	return nil
+}
+
+func (memoryBackend) loadChanges() ([]Event, error) {
+	return nil, nil
+}
+
+func (memoryBackend) appendChanges(events []Event) error {
+	return nil
+}
+
+func (memoryBackend) resetChanges() error {
+	return nil
+}
+
+func (m *memoryBackend) appendAudit(entries []AuditEntry) error {
+	m.audit = append(m.audit, entries...)
+	return nil
+}
+
+func (m *memoryBackend) readAudit(fn func(AuditEntry) error) error {
+	for _, entry := range m.audit {
+		err := fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (memoryBackend) close() error {
+	return nil
+}
+
+// fillEmptyMaps makes sure every map in dbData can be written to, even if
+// it was missing from the file it was loaded from.
+func fillEmptyMaps(dbData *DBData) {
+	if dbData.Chirps == nil {
+		dbData.Chirps = map[int]ChirpResource{}
+	}
+	if dbData.Users == nil {
+		dbData.Users = map[int]DetailedUserResource{}
+	}
+	if dbData.RevokedTokens == nil {
+		dbData.RevokedTokens = map[string]int64{}
+	}
+	if dbData.Revocations == nil {
+		dbData.Revocations = map[string]Revocation{}
+	}
+	if dbData.Holds == nil {
+		dbData.Holds = map[string]LegalHold{}
+	}
+	if dbData.Revisions == nil {
+		dbData.Revisions = map[int]ChirpHistory{}
+	}
+	if dbData.Sequences == nil {
+		dbData.Sequences = map[string]int{}
+	}
+}
+
+// seedSequences makes sure no sequence is behind the highest ID in use, which
+// is the case for files written before sequences were tracked.
+func seedSequences(dbData *DBData) {
+	for id := range dbData.Chirps {
+		if id > dbData.Sequences[entityChirp] {
+			dbData.Sequences[entityChirp] = id
+		}
+	}
+	for id := range dbData.Users {
+		if id > dbData.Sequences[entityUser] {
+			dbData.Sequences[entityUser] = id
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// every runs fn each interval on its own goroutine until the DB is closed.
+func (db *DB) every(interval time.Duration, name string, fn func() error) {
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := fn()
+				if err != nil {
+					log.Printf("Error running %v %v", name, err)
+				}
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops all background work, writes out anything still pending and
+// lets go of the database files. The DB can't be changed after it has been
+// closed. If the pending changes can't be written out, they are lost and
+// Close fails with the reason.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	if db.closed {
+		db.mux.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mux.Unlock()
+
+	close(db.stop)
+	db.background.Wait()
+	db.changes.close()
+	err := db.Flush()
+	if err != nil {
+		db.store.close()
+		return fmt.Errorf("changes since the last flush are lost: %w", err)
+	}
+	return db.store.close()
+}
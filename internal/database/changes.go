@@ -0,0 +1,355 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ops of a change Event.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Entities a change Event can be about.
+const (
+	EntityChirp      = entityChirp
+	EntityUser       = entityUser
+	EntityRevocation = entityRevocation
+	EntityHold       = entityHold
+	EntityRevision   = entityRevision
+)
+
+// entityChange is the sequence change events are numbered from.
+const entityChange = "change"
+
+// defaultChangeLogSize is how many change events are kept when
+// Options.ChangeLogSize is not set.
+const defaultChangeLogSize = 10000
+
+var ErrChangesTruncated = newError(ErrConflict, "Changes are no longer kept that far back, resync from a snapshot")
+
+// Event is a single change to a chirp, user, revocation, legal hold or the
+// revisions of a chirp. Seq numbers every change ever made in order, and is
+// never reused, so a consumer that remembers the last Seq it handled can
+// pick up where it left off with Subscribe or Changes. Before is empty for
+// OpCreate and After for OpDelete.
+// Use DecodeEvent to get at them as resources.
+type Event struct {
+	Seq    int             `json:"seq"`
+	Time   time.Time       `json:"time"`
+	Entity string          `json:"entity"`
+	Op     string          `json:"op"`
+	Key    string          `json:"key"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// DecodeEvent decodes the before and after state of e into T, which should
+// match e.Entity: ChirpResource, DetailedUserResource, Revocation,
+// LegalHold or ChirpHistory. Either is nil if the event has no such state.
+func DecodeEvent[T any](e Event) (before *T, after *T, err error) {
+	if len(e.Before) > 0 {
+		before = new(T)
+		err = json.Unmarshal(e.Before, before)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(e.After) > 0 {
+		after = new(T)
+		err = json.Unmarshal(e.After, after)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return before, after, nil
+}
+
+// change queues rec to be logged and turns it into an Event for
+// subscribers. before is the state rec replaces, if existed.
+func (tx *Tx) change(rec record, before interface{}, existed bool) error {
+	event := Event{Entity: rec.Entity, Op: OpCreate, Key: rec.Key, After: rec.Value}
+	if existed {
+		data, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		event.Before = data
+		event.Op = OpUpdate
+	}
+	if rec.Op == opDelete {
+		event.Op = OpDelete
+	}
+	tx.records = append(tx.records, rec)
+	tx.events = append(tx.events, event)
+	return nil
+}
+
+// stampEvents numbers the events of a transaction that is about to be
+// committed, and times those that don't carry a time already.
+func (tx *Tx) stampEvents(now time.Time) error {
+	if len(tx.events) == 0 {
+		return nil
+	}
+	last := tx.data.Sequences[entityChange]
+	for idx := range tx.events {
+		tx.events[idx].Seq = last + idx + 1
+		if tx.events[idx].Time.IsZero() {
+			tx.events[idx].Time = now
+		}
+	}
+	return tx.setSequence(entityChange, last+len(tx.events))
+}
+
+// changeLog keeps the most recent events in memory for subscribers to read
+// from. Events up to and including floor are no longer available.
+type changeLog struct {
+	mux    *sync.Mutex
+	events []Event
+	floor  int
+	size   int
+	notify chan struct{}
+	closed bool
+}
+
+// newChangeLog starts a log from the events loaded from disk. last is the
+// sequence number of the newest change that was made, which is past the
+// newest loaded event if the process died before they were written out.
+func newChangeLog(events []Event, last int, size int) *changeLog {
+	if size <= 0 {
+		size = defaultChangeLogSize
+	}
+	c := &changeLog{
+		mux:    &sync.Mutex{},
+		floor:  last,
+		size:   size,
+		notify: make(chan struct{}),
+	}
+	if len(events) > 0 && events[len(events)-1].Seq == last {
+		c.events = events
+		c.floor = events[0].Seq - 1
+		c.trim()
+	}
+	return c
+}
+
+func (c *changeLog) append(events []Event) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.events = append(c.events, events...)
+	c.trim()
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+func (c *changeLog) trim() {
+	if len(c.events) <= c.size {
+		return
+	}
+	drop := len(c.events) - c.size
+	c.floor = c.events[drop-1].Seq
+	c.events = append([]Event(nil), c.events[drop:]...)
+}
+
+// reset forgets every event, for when the data they describe has been
+// replaced wholesale. last is the sequence number new events continue from.
+func (c *changeLog) reset(last int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.events = nil
+	c.floor = last
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+func (c *changeLog) close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.notify)
+}
+
+// since returns up to limit events after the given sequence number, and a
+// channel that is closed as soon as more are appended.
+func (c *changeLog) since(after int, limit int) ([]Event, <-chan struct{}, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+	if after < c.floor {
+		return nil, nil, ErrChangesTruncated
+	}
+	last := c.floor + len(c.events)
+	if after > last {
+		return nil, nil, newError(ErrInvalid, fmt.Sprintf("No change %v has been made yet, the last one is %v", after, last))
+	}
+	events := c.events[after-c.floor:]
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return append([]Event(nil), events...), c.notify, nil
+}
+
+func (c *changeLog) last() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.floor + len(c.events)
+}
+
+// LastChangeSeq returns the sequence number of the newest change made, or
+// zero if none was made yet.
+func (db *DB) LastChangeSeq() int {
+	return db.changes.last()
+}
+
+// Changes returns up to limit of the changes made after the given sequence
+// number, oldest first. It fails with ErrChangesTruncated if some of those
+// changes are no longer kept. A limit of zero or less returns all of them.
+func (db *DB) Changes(after int, limit int) ([]Event, error) {
+	events, _, err := db.changes.since(after, limit)
+	return events, err
+}
+
+// Subscription delivers change events on C, in order, until it is closed or
+// falls too far behind. Err tells why C was closed.
+type Subscription struct {
+	C    <-chan Event
+	err  error
+	done chan struct{}
+	once *sync.Once
+}
+
+// Subscribe delivers every change made after the given sequence number,
+// first catching up on the ones that are still kept and then following new
+// ones as they are made. Pass LastChangeSeq() to only see new changes.
+// Events are delivered as fast as the subscriber reads them; one that falls
+// more than Options.ChangeLogSize changes behind is closed with
+// ErrChangesTruncated.
+func (db *DB) Subscribe(after int) (*Subscription, error) {
+	_, _, err := db.changes.since(after, 1)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan Event)
+	s := &Subscription{C: c, done: make(chan struct{}), once: &sync.Once{}}
+	go func() {
+		defer close(c)
+		for {
+			events, notify, err := db.changes.since(after, 100)
+			if err != nil {
+				s.err = err
+				return
+			}
+			for _, event := range events {
+				select {
+				case c <- event:
+					after = event.Seq
+				case <-s.done:
+					return
+				}
+			}
+			if len(events) > 0 {
+				continue
+			}
+			select {
+			case <-notify:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Close stops the subscription. C is closed shortly after.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Err returns why C was closed: ErrChangesTruncated, ErrClosed once the DB
+// was closed, or nil if Close was called. Only valid once C is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// appendChanges writes events to the end of the change log at path.
+func appendChanges(path string, events []Event, s *sealer) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := bytes.Buffer{}
+	for _, event := range events {
+		line, err := encodeLine(event, s)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readChanges returns the newest keep events in the change log at path. Like
+// the WAL, a half-written last line is ignored.
+func readChanges(path string, keep int, s *sealer) ([]Event, error) {
+	lines, err := readLogLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for _, line := range lines {
+		event := Event{}
+		err := decodeLine(line, s, &event)
+		if errors.Is(err, ErrNoKey) || errors.Is(err, ErrWrongKey) {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if len(events) > keep {
+		events = events[len(events)-keep:]
+	}
+	return events, nil
+}
+
+// writeChanges replaces the change log at path with events.
+func writeChanges(path string, events []Event, s *sealer) error {
+	buf := bytes.Buffer{}
+	for _, event := range events {
+		line, err := encodeLine(event, s)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	key := make([]byte, 32)
+	opts := Options{FlushEvery: 1, ChangeLogSize: 5, EncryptionKey: key}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := db.CreateUsers(ctx, "a@b.co", "h")
+	c, _ := db.CreateChirp(ctx, "hi", u.ID)
+	db.MarkUserChirpyRed(ctx, u.ID)
+	db.DeleteChirp(ctx, c.ID, u.ID)
+	var got []Event
+	for i := 0; i < 4; i++ {
+		got = append(got, <-sub.C)
+	}
+	if got[0].Op != "create" || got[1].Entity != "chirp" || got[2].Op != "update" || got[3].Op != "update" || got[3].Seq != 4 {
+		t.Fatalf("%+v", got)
+	}
+	before, after, err := DecodeEvent[DetailedUserResource](got[2])
+	if err != nil || before.IsChirpyRed || !after.IsChirpyRed {
+		t.Fatal(before, after, err)
+	}
+	// failed tx emits nothing
+	if err := db.DeleteChirp(ctx, 999, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if db.LastChangeSeq() != 4 {
+		t.Fatal(db.LastChangeSeq())
+	}
+	for i := 0; i < 5; i++ {
+		db.CreateChirp(ctx, "x", u.ID)
+	}
+	if _, err := db.Changes(2, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Fatal(err)
+	}
+	evs, err := db.Changes(6, 2)
+	if err != nil || len(evs) != 2 || evs[0].Seq != 7 {
+		t.Fatal(evs, err)
+	}
+	// subscriber was kept up? drain 5 more
+	for i := 0; i < 5; i++ {
+		e := <-sub.C
+		if e.Seq != 5+i {
+			t.Fatal(e)
+		}
+	}
+	db.Close()
+	if _, ok := <-sub.C; ok || !errors.Is(sub.Err(), ErrClosed) {
+		t.Fatal(sub.Err())
+	}
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.LastChangeSeq() != 9 {
+		t.Fatal(db.LastChangeSeq())
+	}
+	evs, err = db.Changes(4, 0)
+	if err != nil || len(evs) != 5 {
+		t.Fatal(evs, err)
+	}
+	// rotate key keeps the changes readable
+	if err := db.RotateKey(nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	opts.EncryptionKey = nil
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs, err = db.Changes(4, 0)
+	if err != nil || len(evs) != 5 {
+		t.Fatal(evs, err)
+	}
+	snap, err := db.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp(ctx, "after", u.ID)
+	sub, _ = db.Subscribe(db.LastChangeSeq())
+	if _, err := db.RestoreSnapshot(ctx, snap.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sub.C; ok || !errors.Is(sub.Err(), ErrChangesTruncated) {
+		t.Fatal(sub.Err())
+	}
+	db.CreateChirp(ctx, "again", u.ID)
+	if db.LastChangeSeq() != 12 {
+		t.Fatal(db.LastChangeSeq())
+	}
+	db.Close()
+}
+
+func TestChangesAppendAfterTornEvent(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	opts := Options{FlushEvery: 1}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	db.Close()
+
+	// A crash while appending the next event leaves half of it behind
+	f, err := os.OpenFile(path+".changes", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"entity":"ch`)
+	f.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp(ctx, "hi", u.ID)
+	db.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	events, err := db.Changes(0, 0)
+	if err != nil || len(events) != 2 || events[1].Seq != 2 || events[1].Entity != "chirp" {
+		t.Fatalf("%+v %v", events, err)
+	}
+}
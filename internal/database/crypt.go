@@ -0,0 +1,100 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var ErrNoKey = errors.New("database file is encrypted but no encryption key was given")
+var ErrWrongKey = errors.New("database file could not be decrypted with the given encryption key")
+
+// sealer encrypts and decrypts database files with AES-256-GCM. A nil
+// *sealer means the files are kept in plaintext.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// ParseEncryptionKey decodes a base64 encoded 32 byte key, as generated by
+// `openssl rand -base64 32`. An empty string means no key.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Encryption key is not valid base64: %v", err))
+	}
+	if len(key) != 32 {
+		return nil, errors.New(fmt.Sprintf("Encryption key must be 32 bytes, got %v", len(key)))
+	}
+	return key, nil
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns a fresh random nonce followed by the encrypted plaintext.
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNoKey
+	}
+	size := s.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, ErrWrongKey
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plaintext, nil
+}
+
+// RotateKey re-encrypts the database files, backups and snapshots included,
+// under key. A nil key decrypts them. Only databases kept on disk can be
+// rotated.
+func (db *DB) RotateKey(key []byte) error {
+	store, ok := db.store.(*jsonFileBackend)
+	if !ok {
+		return errors.New("Only file backed databases can be encrypted")
+	}
+	next, err := newSealer(key)
+	if err != nil {
+		return err
+	}
+
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err = db.writePending()
+	if err != nil {
+		return err
+	}
+	return store.reencrypt(db.data, store.sealer, next)
+}
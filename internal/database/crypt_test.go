@@ -0,0 +1,99 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/db.json"
+	k1 := make([]byte, 32)
+	k2 := make([]byte, 32)
+	k2[0] = 1
+	db, _ := NewDB(path, Options{Backups: 2})
+	db.CreateUsers(ctx, "plain@x.y", "h")
+	db.Close()
+	db, err := NewDB(path, Options{Backups: 2, EncryptionKey: k1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "secret@x.y", "h")
+	db.Close()
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		raw, _ := os.ReadFile(dir + "/" + e.Name())
+		if bytes.Contains(raw, []byte("@x.y")) {
+			t.Fatal("plaintext in", e.Name())
+		}
+	}
+	_, err = NewDB(path, Options{})
+	if !errors.Is(err, ErrNoKey) {
+		t.Fatal(err)
+	}
+	_, err = NewDB(path, Options{EncryptionKey: k2})
+	if !errors.Is(err, ErrWrongKey) {
+		t.Fatal(err)
+	}
+	db, _ = NewDB(path, Options{Backups: 2, EncryptionKey: k1})
+	if err := db.RotateKey(k2); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewDB(path, Options{Backups: 2, EncryptionKey: k2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.GetUsers(); len(u) != 2 {
+		t.Fatal(u)
+	}
+	db.Close()
+	if _, err := DryRunMigrations(path, k2); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte("garbage"), 0600)
+	db, err = NewDB(path, Options{Backups: 2, EncryptionKey: k2, RecoverFromBackup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Backups were rotated to the new key as well
+	if u, _ := db.GetUsers(); len(u) != 2 {
+		t.Fatal(u)
+	}
+}
+
+func TestRotateKeyKeepsSnapshots(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	k1 := make([]byte, 32)
+	k2 := make([]byte, 32)
+	k2[0] = 1
+	db, err := NewDB(path, Options{EncryptionKey: k1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "h")
+	snapshot, err := db.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "d@b.c", "h")
+	if err := db.RotateKey(k2); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path, Options{EncryptionKey: k2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.RestoreSnapshot(ctx, snapshot.Name); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := db.GetUsers(); len(users) != 1 {
+		t.Fatal(users)
+	}
+}
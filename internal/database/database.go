@@ -1,10 +1,9 @@
 package database
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
-	"os"
+	"context"
+	"net/mail"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,15 +11,29 @@ import (
 type ChirpResource struct {
 	Body     string `json:"body"`
 	ID       int    `json:"id"`
+	PublicID string `json:"public_id,omitempty"`
 	AuthorID int    `json:"author_id"`
+	// CreatedAt and UpdatedAt are set by the database, UpdatedAt whenever
+	// the chirp changes, including when it is trashed or restored.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// Edited is set once the body has been changed by its author, last at
+	// EditedAt. The bodies it had before are kept as revisions.
+	Edited   bool       `json:"edited"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// DeletedAt is set once the chirp has been moved to the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type UserResource struct {
-	Email        string `json:"email"`
-	ID           int    `json:"id"`
-	Token        string `json:"token,omitempty"`
-	RefreshToken string `json:"refresh_token,omitempty"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Email        string     `json:"email"`
+	ID           int        `json:"id"`
+	PublicID     string     `json:"public_id,omitempty"`
+	Token        string     `json:"token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	IsChirpyRed  bool       `json:"is_chirpy_red"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
 }
 
 type AuthUserResource struct {
@@ -32,293 +45,487 @@ type AuthUserResource struct {
 type DetailedUserResource struct {
 	Email            string `json:"email"`
 	ID               int    `json:"id"`
+	PublicID         string `json:"public_id,omitempty"`
 	Password         string `json:"password"`
 	ExpiresInSeconds *int   `json:"expires_in_seconds"`
 	IsChirpyRed      bool   `json:"is_chirpy_red"`
+	// CreatedAt and UpdatedAt are set by the database like they are on
+	// chirps.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// DeletedAt is set once the user has deleted their account. It is kept
+	// until the deleted-users retention rule purges it.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type DBData struct {
+	SchemaVersion int                          `json:"schema_version"`
 	Chirps        map[int]ChirpResource        `json:"chirps"`
 	Users         map[int]DetailedUserResource `json:"users"`
-	RevokedTokens map[string]int64             `json:"revoked_tokens"`
+	// RevokedTokens held raw refresh tokens before schema version 2, and is
+	// only read to migrate them over to Revocations.
+	RevokedTokens map[string]int64      `json:"revoked_tokens,omitempty"`
+	Revocations   map[string]Revocation `json:"revocations"`
+	// Holds are the legal holds placed on users and chirps, keyed by holdKey.
+	Holds map[string]LegalHold `json:"holds"`
+	// Revisions holds the earlier bodies of every edited chirp, keyed by
+	// chirp ID.
+	Revisions map[int]ChirpHistory `json:"revisions"`
+	// Sequences holds the last ID handed out per entity, so IDs are never
+	// reused even after the record holding them is deleted.
+	Sequences map[string]int `json:"sequences"`
 }
 
+// DB keeps the whole of DBData in memory and serves every read from there.
+// Changes are handed to the backend in batches by flush, either every
+// FlushInterval or once FlushEvery changes have piled up.
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	store backend
+	mux   *sync.RWMutex
+	data  DBData
+	ix    *indexes
+
+	flushMux      *sync.Mutex
+	flushErr      error
+	pending       []record
+	pendingEvents []Event
+	changes       *changeLog
+	pendingAudit  []AuditEntry
+	chain         auditChain
+	retention     *retentionStats
+	opts          Options
+	follower      bool
+	closed        bool
+	stop          chan struct{}
+	background    *sync.WaitGroup
 }
 
-var DataBase DB
-
-func NewDB(path string, isDebug bool) (*DB, error) {
-	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
-	}
-	if isDebug {
-		cleanupErr := db.cleanupDBFile()
-		if cleanupErr != nil {
-			return db, cleanupErr
-		}
-	}
-	err := db.ensureDB()
-	return db, err
+// Options tune how a DB persists its data.
+type Options struct {
+	// Debug removes any existing database files before opening.
+	Debug bool
+	// FlushInterval is how often pending changes are written to disk. Zero
+	// disables the periodic flush.
+	FlushInterval time.Duration
+	// FlushEvery writes pending changes to disk as soon as this many have
+	// piled up. Zero or less flushes after every change.
+	FlushEvery int
+	// Backups is how many of the most recent snapshots are kept around as
+	// backups. Zero keeps none.
+	Backups int
+	// RecoverFromBackup replaces a corrupt snapshot with the newest valid
+	// backup on startup, instead of refusing to open.
+	RecoverFromBackup bool
+	// EncryptionKey encrypts the database files with AES-256-GCM when set.
+	// Existing plaintext files are encrypted the first time they are opened
+	// with a key. See ParseEncryptionKey.
+	EncryptionKey []byte
+	// LockTimeout is how long to wait for another process to let go of the
+	// database files before giving up with a *LockedError.
+	LockTimeout time.Duration
+	// PruneInterval is how often the Retention rules are applied. Zero
+	// disables purging.
+	PruneInterval time.Duration
+	// Retention are the rules deciding when data is purged. Nil uses
+	// DefaultRetentionRules.
+	Retention []RetentionRule
+	// RetentionDryRun only logs what the Retention rules would purge when
+	// they are applied every PruneInterval, without purging anything.
+	RetentionDryRun bool
+	// EditWindow is how long after it was posted a chirp can be edited by
+	// its author. Zero disables editing.
+	EditWindow time.Duration
+	// PublicIDs gives every new chirp and user an opaque, time sortable
+	// PublicID alongside its integer ID.
+	PublicIDs bool
+	// ChangeLogSize is how many of the newest change events are kept for
+	// consumers to catch up on. Zero keeps 10000.
+	ChangeLogSize int
 }
 
-func (db *DB) CreateUsers(email string, hash string) (UserResource, error) {
-	var user UserResource
-	dbData, err := db.loadDB()
+var DataBase DB
+
+// NewDB returns a DB persisted to the JSON file at path.
+func NewDB(path string, opts Options) (*DB, error) {
+	store, err := newJSONFileBackend(path, opts)
 	if err != nil {
-		return user, nil
-	}
-	newId := len(dbData.Users) + 1
-	user = UserResource{
-		Email: email,
-		ID:    newId,
-	}
-	dbData.Users[newId] = DetailedUserResource{
-		Email:    email,
-		ID:       newId,
-		Password: hash,
+		return nil, err
 	}
-	err = db.writeDB(dbData)
+	db, err := openDB(store, opts)
 	if err != nil {
-		return UserResource{}, nil
+		store.close()
+		return nil, err
 	}
-	return user, nil
+	return db, nil
 }
 
-func (db *DB) MarkUserChirpyRed(userID int) error {
-	dbData, err := db.loadDB()
+// NewMemoryDB returns a DB that only lives in memory and never touches disk.
+// Options that only make sense for files on disk are ignored.
+func NewMemoryDB(opts Options) *DB {
+	db, _ := openDB(&memoryBackend{}, opts)
+	return db
+}
+
+func openDB(store backend, opts Options) (*DB, error) {
+	dbData, err := store.load()
 	if err != nil {
-		return err
-	}
-	fmt.Println("Chirpy Check", dbData.Users, userID)
-	user, ok := dbData.Users[userID]
-	if !ok {
-		fmt.Println("Reaches this", dbData.Users, userID)
-		return errors.New("User Not Found")
+		return nil, err
 	}
-	user.IsChirpyRed = true
-	dbData.Users[userID] = user
-	err = db.writeDB(dbData)
+	err = migrate(store, &dbData)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
-
-func (db *DB) CreateChirp(body string, authorId int) (ChirpResource, error) {
-	var chirp ChirpResource
-	dbData, err := db.loadDB()
+	events, err := store.loadChanges()
 	if err != nil {
-		return chirp, err
-	}
-	newId := len(dbData.Chirps) + 1
-	chirp = ChirpResource{
-		Body:     body,
-		ID:       newId,
-		AuthorID: authorId,
+		return nil, err
 	}
-	dbData.Chirps[newId] = chirp
-	err = db.writeDB(dbData)
+	chain, err := lastAuditEntry(store)
 	if err != nil {
-		return ChirpResource{}, err
+		return nil, err
 	}
-	return chirp, nil
+	db := &DB{
+		store:      store,
+		mux:        &sync.RWMutex{},
+		data:       dbData,
+		ix:         buildIndexes(dbData),
+		flushMux:   &sync.Mutex{},
+		changes:    newChangeLog(events, dbData.Sequences[entityChange], opts.ChangeLogSize),
+		chain:      chain,
+		retention:  newRetentionStats(),
+		opts:       opts,
+		stop:       make(chan struct{}),
+		background: &sync.WaitGroup{},
+	}
+	if opts.FlushInterval > 0 {
+		db.every(opts.FlushInterval, "database flush", db.Flush)
+	}
+	if opts.PruneInterval > 0 {
+		db.every(opts.PruneInterval, "retention", func() error {
+			// A follower gets its purges from the leader
+			if db.Follower() {
+				return nil
+			}
+			reports, err := db.ApplyRetention(systemContext, time.Now(), opts.RetentionDryRun)
+			logRetention(reports)
+			return err
+		})
+	}
+	return db, nil
 }
 
-func (db *DB) DeleteChirp(chirpID int, userId int) error {
-	dbData, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-	chirp, ok := dbData.Chirps[chirpID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No chirp found with id %v", chirpID))
+// NormalizeEmail checks that email is a plain address (no display name) and
+// returns it lower cased, so the same address always maps to the same user.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", newError(ErrInvalid, "Invalid email address")
 	}
-	if chirp.AuthorID != userId {
-		return errors.New("Chirp Author Invalid Authorization")
-	}
-	delete(dbData.Chirps, chirpID)
-	err = db.writeDB(dbData)
-	if err != nil {
-		return err
-	}
-	return nil
+	return strings.ToLower(addr.Address), nil
 }
 
-func (db *DB) getChirpMap() (map[int]ChirpResource, error) {
-	dbData, err := db.loadDB()
+func (db *DB) CreateUsers(ctx context.Context, email string, hash string) (UserResource, error) {
+	var user UserResource
+	err := db.UpdateContext(ctx, "CreateUsers", func(tx *Tx) error {
+		newId, err := tx.NextUserID()
+		if err != nil {
+			return err
+		}
+		publicID, err := db.newPublicID()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		user = UserResource{
+			Email:     email,
+			ID:        newId,
+			PublicID:  publicID,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+		}
+		return tx.PutUser(DetailedUserResource{
+			Email:     email,
+			ID:        newId,
+			PublicID:  publicID,
+			Password:  hash,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+		})
+	})
 	if err != nil {
-		return nil, err
+		return UserResource{}, err
 	}
-	return dbData.Chirps, nil
+	return user, nil
 }
 
-func (db *DB) getUserMap() (map[int]UserResource, error) {
-	dbData, err := db.loadDB()
-	if err != nil {
-		return nil, err
+func (db *DB) MarkUserChirpyRed(ctx context.Context, userID int) error {
+	return db.UpdateContext(ctx, "MarkUserChirpyRed", func(tx *Tx) error {
+		user, ok := tx.User(userID)
+		if !ok {
+			return notFoundf("User Not Found")
+		}
+		now := time.Now().UTC()
+		user.IsChirpyRed = true
+		user.UpdatedAt = &now
+		return tx.PutUser(user)
+	})
+}
+
+// MaxChirpLength is the longest body a chirp can have.
+const MaxChirpLength = 140
+
+var bannedWords = []string{"kerfuffle", "sharbert", "fornax"}
+
+// CleanChirpBody checks that body isn't too long for a chirp and masks the
+// banned words in it. Chirps are posted, edited and imported through it.
+func CleanChirpBody(body string) (string, error) {
+	if len(body) > MaxChirpLength {
+		return "", newError(ErrInvalid, "Chirp is too long")
 	}
-	userMap := map[int]UserResource{}
-	for key, val := range dbData.Users {
-		userMap[key] = UserResource{
-			ID:    val.ID,
-			Email: val.Email,
+	clean := strings.TrimSpace(body)
+	for _, token := range strings.Split(body, " ") {
+		for _, banned := range bannedWords {
+			if strings.ToLower(token) == banned {
+				clean = strings.Replace(clean, token, "****", 1)
+			}
 		}
 	}
-	return userMap, nil
+	return clean, nil
 }
 
-func (db *DB) RevokeToken(token string) error {
-	dbData, err := db.loadDB()
+func (db *DB) CreateChirp(ctx context.Context, body string, authorId int) (ChirpResource, error) {
+	var chirp ChirpResource
+	err := db.UpdateContext(ctx, "CreateChirp", func(tx *Tx) error {
+		if author, ok := tx.User(authorId); !ok || author.Deleted() {
+			return newError(ErrForbidden, "User account has been deleted")
+		}
+		newId, err := tx.NextChirpID()
+		if err != nil {
+			return err
+		}
+		publicID, err := db.newPublicID()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		chirp = ChirpResource{
+			Body:      body,
+			ID:        newId,
+			PublicID:  publicID,
+			AuthorID:  authorId,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+		}
+		return tx.PutChirp(chirp)
+	})
 	if err != nil {
-		return err
+		return ChirpResource{}, err
 	}
-	dbData.RevokedTokens[token] = time.Now().UTC().Unix()
-	return db.writeDB(dbData)
+	return chirp, nil
+}
+
+// DeleteChirp moves a chirp to the trash, from which its author can restore
+// it until it is purged.
+func (db *DB) DeleteChirp(ctx context.Context, chirpID int, userId int) error {
+	return db.UpdateContext(ctx, "DeleteChirp", func(tx *Tx) error {
+		chirp, ok := tx.Chirp(chirpID)
+		if !ok || chirp.Trashed() {
+			return notFoundf("No chirp found with id %v", chirpID)
+		}
+		if chirp.AuthorID != userId {
+			return newError(ErrForbidden, "Chirp Author Invalid Authorization")
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		chirp.UpdatedAt = &now
+		return tx.PutChirp(chirp)
+	})
 }
 
-func (db *DB) GetRevokedTokens() (tokens []string, err error) {
-	var revokedTokens []string
-	dbData, err := db.loadDB()
+// GetUserByEmail looks a user up through the email index.
+func (db *DB) GetUserByEmail(email string) (DetailedUserResource, error) {
+	var user DetailedUserResource
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		user, ok = tx.UserByEmail(email)
+		return nil
+	})
 	if err != nil {
-		return revokedTokens, err
+		return user, err
 	}
-	for key := range dbData.RevokedTokens {
-		revokedTokens = append(revokedTokens, key)
+	if !ok || user.Deleted() {
+		return DetailedUserResource{}, notFoundf("No user with email %v found", email)
 	}
-	return revokedTokens, nil
+	return user, nil
 }
 
-func (db *DB) GetUserMapByEmails() (map[string]DetailedUserResource, error) {
-	pwdMap := map[string]DetailedUserResource{}
-	dbData, err := db.loadDB()
+func (db *DB) GetChirp(id int) (ChirpResource, error) {
+	var chirp ChirpResource
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		chirp, ok = tx.Chirp(id)
+		ok = ok && tx.visible(chirp)
+		return nil
+	})
 	if err != nil {
-		return pwdMap, err
+		return chirp, err
 	}
-	for _, entry := range dbData.Users {
-		pwdMap[entry.Email] = entry
+	if !ok {
+		return ChirpResource{}, notFoundf("No chirp with id %v found", id)
 	}
-	return pwdMap, nil
+	return chirp, nil
 }
 
-func (db *DB) GetChirp(id int) (ChirpResource, error) {
+// GetChirpByPublicID looks a chirp up by the opaque ID it was given when
+// PublicIDs is enabled.
+func (db *DB) GetChirpByPublicID(publicID string) (ChirpResource, error) {
 	var chirp ChirpResource
-	chirpMap, err := db.getChirpMap()
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		chirp, ok = tx.ChirpByPublicID(publicID)
+		ok = ok && tx.visible(chirp)
+		return nil
+	})
 	if err != nil {
-		return chirp, nil
+		return chirp, err
 	}
-	chirp, ok := chirpMap[id]
 	if !ok {
-		return chirp, errors.New(fmt.Sprintf("No chirp with id %v found", id))
+		return ChirpResource{}, notFoundf("No chirp with id %v found", publicID)
 	}
 	return chirp, nil
 }
 
 func (db *DB) GetChirps() ([]ChirpResource, error) {
 	var chirps []ChirpResource
-	chirpMap, err := db.getChirpMap()
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.visibleChirps(tx.Chirps())
+		return nil
+	})
 	if err != nil {
-		return chirps, nil
-	}
-	for _, chirp := range chirpMap {
-		chirps = append(chirps, chirp)
+		return chirps, err
 	}
 	return chirps, nil
 }
 
+// GetChirpsByAuthor returns every chirp written by the given user, looked up
+// through the author index.
+func (db *DB) GetChirpsByAuthor(authorID int) ([]ChirpResource, error) {
+	var chirps []ChirpResource
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.visibleChirps(tx.ChirpsByAuthor(authorID))
+		return nil
+	})
+	return chirps, err
+}
+
+// visible reports whether chirp is shown to anyone but its author, which it
+// isn't once it is in the trash or its author has deleted their account.
+func (tx *Tx) visible(chirp ChirpResource) bool {
+	if chirp.Trashed() {
+		return false
+	}
+	author, ok := tx.User(chirp.AuthorID)
+	return !ok || !author.Deleted()
+}
+
+func (tx *Tx) visibleChirps(chirps []ChirpResource) []ChirpResource {
+	var visible []ChirpResource
+	for _, chirp := range chirps {
+		if tx.visible(chirp) {
+			visible = append(visible, chirp)
+		}
+	}
+	return visible
+}
+
 func (db *DB) GetUser(id int) (UserResource, error) {
 	var user UserResource
-	userMap, err := db.getUserMap()
+	var detailed DetailedUserResource
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		detailed, ok = tx.User(id)
+		return nil
+	})
 	if err != nil {
-		return user, nil
+		return user, err
 	}
-	user, ok := userMap[id]
-	if !ok {
-		return user, errors.New(fmt.Sprintf("No user with id %v found", id))
+	if !ok || detailed.Deleted() {
+		return user, notFoundf("No user with id %v found", id)
 	}
-	return user, nil
+	return toUserResource(detailed), nil
 }
 
 func (db *DB) GetUsers() ([]UserResource, error) {
 	var users []UserResource
-	userMap, err := db.getUserMap()
+	err := db.View(func(tx *Tx) error {
+		for _, user := range tx.Users() {
+			if !user.Deleted() {
+				users = append(users, toUserResource(user))
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return users, nil
-	}
-	for _, user := range userMap {
-		users = append(users, user)
+		return users, err
 	}
 	return users, nil
 }
 
-func (db *DB) UpdateUsers(user DetailedUserResource) error {
-	dbData, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	dbData.Users[user.ID] = user
-
-	return db.writeDB(dbData)
-}
-
-func (db *DB) createDB() error {
-	return db.writeDB(DBData{
-		Chirps:        map[int]ChirpResource{},
-		Users:         map[int]DetailedUserResource{},
-		RevokedTokens: map[string]int64{},
+// UpdateUsers stores the email and password of user. Fields only chirpy
+// itself manages are kept as they are.
+func (db *DB) UpdateUsers(ctx context.Context, user DetailedUserResource) error {
+	return db.UpdateContext(ctx, "UpdateUsers", func(tx *Tx) error {
+		existing, ok := tx.User(user.ID)
+		if ok && existing.Deleted() {
+			return notFoundf("No user with id %v found", user.ID)
+		}
+		now := time.Now().UTC()
+		user.CreatedAt = &now
+		if ok {
+			user.PublicID = existing.PublicID
+			user.IsChirpyRed = existing.IsChirpyRed
+			user.CreatedAt = existing.CreatedAt
+		}
+		user.UpdatedAt = &now
+		user.DeletedAt = nil
+		return tx.PutUser(user)
 	})
 }
 
-func (db *DB) cleanupDBFile() error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	err := os.Remove(db.path)
-	if err != nil {
-		return err
-	}
-	return nil
+// DeleteUser deletes the given user's account. The user can no longer log
+// in and their chirps are hidden, but both are only purged for good by the
+// deleted-users retention rule.
+func (db *DB) DeleteUser(ctx context.Context, userID int) error {
+	return db.UpdateContext(ctx, "DeleteUser", func(tx *Tx) error {
+		user, ok := tx.User(userID)
+		if !ok || user.Deleted() {
+			return notFoundf("No user with id %v found", userID)
+		}
+		now := time.Now().UTC()
+		user.DeletedAt = &now
+		user.UpdatedAt = &now
+		return tx.PutUser(user)
+	})
 }
 
-func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if os.IsNotExist(err) {
-		return db.createDB()
-	}
-
-	return err
+// Deleted reports whether the user has deleted their account.
+func (user DetailedUserResource) Deleted() bool {
+	return user.DeletedAt != nil
 }
 
-func (db *DB) loadDB() (DBData, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	dbData := DBData{}
-	data, err := os.ReadFile(db.path)
-	if err != nil {
-		return dbData, err
-	}
-	err = json.Unmarshal(data, &dbData)
-	if err != nil {
-		return dbData, err
+func (db *DB) newPublicID() (string, error) {
+	if !db.opts.PublicIDs {
+		return "", nil
 	}
-	return dbData, nil
+	return publicIDs.next(time.Now())
 }
 
-func (db *DB) writeDB(dbData DBData) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	data, err := json.Marshal(dbData)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(db.path, data, 0600)
-	if err != nil {
-		return err
+func toUserResource(user DetailedUserResource) UserResource {
+	return UserResource{
+		ID:        user.ID,
+		Email:     user.Email,
+		PublicID:  user.PublicID,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
 	}
-	return nil
 }
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUniqueEmails(t *testing.T) {
+	for email, want := range map[string]string{
+		" A@B.c ":          "a@b.c",
+		"a@b.c":            "a@b.c",
+		"A <a@b.c>":        "",
+		"not an email":     "",
+		"a@b.c, other@b.c": "",
+	} {
+		got, err := NormalizeEmail(email)
+		if want == "" && !errors.Is(err, ErrInvalid) || want != "" && got != want {
+			t.Fatal(email, got, err)
+		}
+	}
+
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	u, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	if _, err := db.CreateUsers(ctx, "A@b.C", "h"); !errors.Is(err, ErrConflict) {
+		t.Fatal(err)
+	}
+	other, _ := db.CreateUsers(ctx, "d@b.c", "h")
+	err := db.UpdateUsers(ctx, DetailedUserResource{ID: other.ID, Email: "a@b.c", Password: "h"})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatal(err)
+	}
+	// Changing the case of your own email isn't taking someone else's
+	err = db.UpdateUsers(ctx, DetailedUserResource{ID: u.ID, Email: "A@b.c", Password: "h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanChirpBody(t *testing.T) {
+	body, err := CleanChirpBody(" what a Kerfuffle day, kerfuffle ")
+	if err != nil || body != "what a **** day, ****" {
+		t.Fatal(body, err)
+	}
+	if _, err := CleanChirpBody(strings.Repeat("x", MaxChirpLength)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CleanChirpBody(strings.Repeat("x", MaxChirpLength+1)); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+}
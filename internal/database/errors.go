@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every error returned by this package that is the caller's fault matches one
+// of these with errors.Is, so callers can tell them apart without looking at
+// the message.
+var (
+	ErrNotFound  = errors.New("Not Found")
+	ErrForbidden = errors.New("Forbidden")
+	ErrConflict  = errors.New("Conflict")
+	ErrInvalid   = errors.New("Invalid")
+)
+
+var ErrReadOnlyTx = errors.New("cannot modify the database in a read-only transaction")
+var ErrClosed = errors.New("database is closed")
+var ErrEmailTaken = newError(ErrConflict, "Email already in use")
+
+// Error is an error of one of the kinds above, with a message meant to be
+// shown to whoever caused it.
+type Error struct {
+	Kind error
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func newError(kind error, msg string) *Error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+func notFoundf(format string, args ...interface{}) error {
+	return newError(ErrNotFound, fmt.Sprintf(format, args...))
+}
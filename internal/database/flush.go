@@ -0,0 +1,51 @@
+package database
+
+// Flush hands every pending change to the backend. It is safe to call at any
+// time, and is called for you by the periodic flush and by Close.
+func (db *DB) Flush() error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	// Hold the read lock so the backend sees data that matches the records
+	// it is given, while still letting View calls through.
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	db.flushErr = db.writePending()
+	return db.flushErr
+}
+
+// FlushError returns why the last flush failed, or nil if it went through.
+// Changes stay pending in memory until a flush succeeds, so they are lost if
+// the process stops before then.
+func (db *DB) FlushError() error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	return db.flushErr
+}
+
+// writePending hands pending changes to the backend, followed by the events
+// describing them. Audit entries go first, so no change is ever persisted
+// without one. The caller must hold flushMux and at least a read lock.
+func (db *DB) writePending() error {
+	err := db.store.appendAudit(db.pendingAudit)
+	if err != nil {
+		return err
+	}
+	db.pendingAudit = nil
+	if len(db.pending) == 0 {
+		return nil
+	}
+	err = db.store.write(db.data, db.pending)
+	if err != nil {
+		return err
+	}
+	db.pending = nil
+	err = db.store.appendChanges(db.pendingEvents)
+	if err != nil {
+		return err
+	}
+	db.pendingEvents = nil
+	return nil
+}
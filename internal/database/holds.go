@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// LegalHold exempts a user or chirp from every retention rule until it is
+// released. A hold on a user also covers all of their chirps.
+type LegalHold struct {
+	Entity   string    `json:"entity"`
+	ID       int       `json:"id"`
+	Reason   string    `json:"reason,omitempty"`
+	PlacedAt time.Time `json:"placed_at"`
+}
+
+// holdKey is how holds are keyed in DBData.Holds, e.g. "chirp:12".
+func holdKey(entity string, id int) string {
+	return entity + ":" + strconv.Itoa(id)
+}
+
+// chirpHeld reports whether chirp, or its author, is under a legal hold.
+func (tx *Tx) chirpHeld(chirp ChirpResource) bool {
+	_, held := tx.Hold(entityChirp, chirp.ID)
+	if held {
+		return true
+	}
+	_, held = tx.Hold(entityUser, chirp.AuthorID)
+	return held
+}
+
+// userHeld reports whether the user, or any of their chirps, is under a
+// legal hold. Either keeps the user around, so held chirps keep an author.
+func (tx *Tx) userHeld(id int) bool {
+	_, held := tx.Hold(entityUser, id)
+	if held {
+		return true
+	}
+	for _, chirp := range tx.ChirpsByAuthor(id) {
+		if _, held := tx.Hold(entityChirp, chirp.ID); held {
+			return true
+		}
+	}
+	return false
+}
+
+// PlaceHold puts the given user or chirp under a legal hold. Placing a hold
+// that is already there updates its reason.
+func (db *DB) PlaceHold(ctx context.Context, entity string, id int, reason string) (LegalHold, error) {
+	hold := LegalHold{Entity: entity, ID: id, Reason: reason, PlacedAt: time.Now().UTC()}
+	err := db.UpdateContext(ctx, "PlaceHold", func(tx *Tx) error {
+		var ok bool
+		switch entity {
+		case entityChirp:
+			_, ok = tx.Chirp(id)
+		case entityUser:
+			_, ok = tx.User(id)
+		default:
+			return newError(ErrInvalid, fmt.Sprintf("Only users and chirps can be held, not %v", entity))
+		}
+		if !ok {
+			return notFoundf("No %v with id %v found", entity, id)
+		}
+		if existing, ok := tx.Hold(entity, id); ok {
+			hold.PlacedAt = existing.PlacedAt
+		}
+		return tx.PutHold(hold)
+	})
+	if err != nil {
+		return LegalHold{}, err
+	}
+	return hold, nil
+}
+
+// ReleaseHold lifts the legal hold on the given user or chirp.
+func (db *DB) ReleaseHold(ctx context.Context, entity string, id int) error {
+	return db.UpdateContext(ctx, "ReleaseHold", func(tx *Tx) error {
+		if _, ok := tx.Hold(entity, id); !ok {
+			return notFoundf("No hold on %v %v found", entity, id)
+		}
+		return tx.DeleteHold(entity, id)
+	})
+}
+
+func (db *DB) GetHolds() ([]LegalHold, error) {
+	var holds []LegalHold
+	err := db.View(func(tx *Tx) error {
+		holds = tx.Holds()
+		return nil
+	})
+	return holds, err
+}
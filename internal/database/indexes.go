@@ -0,0 +1,81 @@
+package database
+
+import (
+	"strings"
+)
+
+// indexes are secondary lookups over DBData. They are never persisted, but
+// built whenever the data is loaded and kept in step with every change made
+// through a Tx.
+type indexes struct {
+	userByEmail     map[string]int
+	chirpsByAuthor  map[int]map[int]struct{}
+	chirpByPublicID map[string]int
+
+	// terms is the full-text index, holding for every word the chirps it
+	// is in and where, see indexText.
+	terms       map[string]map[int][]int
+	chirpLength map[int]int
+	totalLength int
+}
+
+func buildIndexes(dbData DBData) *indexes {
+	ix := &indexes{
+		userByEmail:     map[string]int{},
+		chirpsByAuthor:  map[int]map[int]struct{}{},
+		chirpByPublicID: map[string]int{},
+		terms:           map[string]map[int][]int{},
+		chirpLength:     map[int]int{},
+	}
+	for _, user := range dbData.Users {
+		ix.addUser(user)
+	}
+	for _, chirp := range dbData.Chirps {
+		ix.addChirp(chirp)
+	}
+	return ix
+}
+
+func (ix *indexes) addChirp(chirp ChirpResource) {
+	byAuthor, ok := ix.chirpsByAuthor[chirp.AuthorID]
+	if !ok {
+		byAuthor = map[int]struct{}{}
+		ix.chirpsByAuthor[chirp.AuthorID] = byAuthor
+	}
+	byAuthor[chirp.ID] = struct{}{}
+	if chirp.PublicID != "" {
+		ix.chirpByPublicID[chirp.PublicID] = chirp.ID
+	}
+	ix.indexText(chirp)
+}
+
+func (ix *indexes) removeChirp(chirp ChirpResource) {
+	byAuthor := ix.chirpsByAuthor[chirp.AuthorID]
+	delete(byAuthor, chirp.ID)
+	if len(byAuthor) == 0 {
+		delete(ix.chirpsByAuthor, chirp.AuthorID)
+	}
+	if ix.chirpByPublicID[chirp.PublicID] == chirp.ID {
+		delete(ix.chirpByPublicID, chirp.PublicID)
+	}
+	ix.unindexText(chirp)
+}
+
+// emailKey is how emails are keyed in the email index. Emails are compared
+// case-insensitively, so a@b.c and A@B.C are the same user.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (ix *indexes) addUser(user DetailedUserResource) {
+	ix.userByEmail[emailKey(user.Email)] = user.ID
+}
+
+func (ix *indexes) removeUser(user DetailedUserResource) {
+	// Only drop the entry if it still points at this user, files from before
+	// emails were unique can hold the same email more than once.
+	key := emailKey(user.Email)
+	if id, ok := ix.userByEmail[key]; ok && id == user.ID {
+		delete(ix.userByEmail, key)
+	}
+}
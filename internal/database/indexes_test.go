@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIndexesFollowRollback(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	db.CreateUsers(ctx, "a@x.y", "h")
+	db.CreateUsers(ctx, "z@x.y", "h")
+	db.CreateChirp(ctx, "c1", 1)
+	db.CreateChirp(ctx, "c2", 2)
+	db.UpdateUsers(ctx, DetailedUserResource{ID: 1, Email: "b@x.y"})
+	if _, err := db.GetUserByEmail("a@x.y"); err == nil {
+		t.Fatal("old email still indexed")
+	}
+	if u, err := db.GetUserByEmail("b@x.y"); err != nil || u.ID != 1 {
+		t.Fatal(u, err)
+	}
+	db.Update(func(tx *Tx) error {
+		tx.DeleteChirp(1)
+		tx.PutUser(DetailedUserResource{ID: 1, Email: "c@x.y"})
+		return errors.New("rollback")
+	})
+	if chirps, _ := db.GetChirpsByAuthor(1); len(chirps) != 1 {
+		t.Fatal(chirps)
+	}
+	if _, err := db.GetUserByEmail("b@x.y"); err != nil {
+		t.Fatal(err)
+	}
+	db.DeleteChirp(ctx, 1, 1)
+	if chirps, _ := db.GetChirpsByAuthor(1); len(chirps) != 0 {
+		t.Fatal(chirps)
+	}
+
+	// After all that, the indexes are what building them afresh gives
+	if !reflect.DeepEqual(db.ix, buildIndexes(db.data)) {
+		t.Fatalf("%+v", db.ix)
+	}
+}
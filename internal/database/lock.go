@@ -0,0 +1,32 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// LockedError is returned when another process already holds the database
+// files. PID is the process that holds them, if it could be read.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%v is in use by another chirpy process", e.Path)
+	}
+	return fmt.Sprintf("%v is in use by another chirpy process (pid %v)", e.Path, e.PID)
+}
+
+// lockFileWithin keeps trying to lock path until timeout has passed.
+func lockFileWithin(path string, exclusive bool, timeout time.Duration) (*fileLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := lockFile(path, exclusive)
+		if _, ok := err.(*LockedError); !ok || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package database
+
+// fileLock is a no-op where flock(2) isn't available. The database is then
+// only protected against other goroutines in the same process.
+type fileLock struct{}
+
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) unlock() error {
+	return nil
+}
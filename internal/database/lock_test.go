@@ -0,0 +1,28 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDB(path, Options{LockTimeout: 300 * time.Millisecond})
+	if _, ok := err.(*LockedError); !ok {
+		t.Fatal(err)
+	}
+	if _, err := DryRunMigrations(path, nil); err == nil {
+		t.Fatal("dry run ran against a locked database")
+	}
+	db.Close()
+
+	db, err = NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
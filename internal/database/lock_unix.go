@@ -0,0 +1,96 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fileLock is an advisory flock(2) lock on a file next to the database. The
+// OS drops it when the process exits, however it exits, so a lock can only
+// go stale on filesystems that don't support flock properly.
+type fileLock struct {
+	file *os.File
+}
+
+// lockFile takes the lock at path without waiting. Exclusive locks are for
+// processes that write to the database and also record their PID in the
+// lock file, shared locks are for processes that only read it.
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		pid := readLockPID(file)
+		file.Close()
+		if pid != 0 && !processAlive(pid) {
+			log.Printf("%v is held for pid %v which is no longer running, the lock may be stale", path, pid)
+		}
+		return nil, &LockedError{Path: path, PID: pid}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if exclusive {
+		pid := readLockPID(file)
+		if pid != 0 && pid != os.Getpid() {
+			log.Printf("Taking over stale lock %v left behind by pid %v", path, pid)
+		}
+		err = writeLockPID(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) unlock() error {
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func readLockPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func writeLockPID(file *os.File) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Migration upgrades DBData from the previous schema version to Version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(dbData *DBData) error
+}
+
+// migrations is the ordered registry of every schema change made to DBData.
+// New migrations are appended to the end with the next version number, and
+// existing ones must never change once released.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "seed id sequences from existing ids",
+		Up: func(dbData *DBData) error {
+			seedSequences(dbData)
+			return nil
+		},
+	},
+	{
+		Version: 2,
+		Name:    "store revoked tokens by hash with their expiry",
+		Up:      hashLegacyRevokedTokens,
+	},
+	{
+		Version: 3,
+		Name:    "backfill created_at and updated_at",
+		Up: func(dbData *DBData) error {
+			backfillTimestamps(dbData, time.Now().UTC())
+			return nil
+		},
+	},
+}
+
+// SchemaVersion is the version of DBData this build reads and writes.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// pendingMigrations returns the migrations that still have to run on data
+// at the given version, in order.
+func pendingMigrations(version int) ([]Migration, error) {
+	if version > SchemaVersion() {
+		return nil, errors.New(fmt.Sprintf("Database schema version %v is newer than supported version %v", version, SchemaVersion()))
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// runMigrations brings dbData up to SchemaVersion and returns the migrations
+// that were applied.
+func runMigrations(dbData *DBData) ([]Migration, error) {
+	pending, err := pendingMigrations(dbData.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	for idx, m := range pending {
+		err = m.Up(dbData)
+		if err != nil {
+			return pending[:idx], errors.New(fmt.Sprintf("Migration %v (%v) failed: %v", m.Version, m.Name, err))
+		}
+		dbData.SchemaVersion = m.Version
+	}
+	return pending, nil
+}
+
+// migrate runs any pending migrations on dbData. The backend gets a chance
+// to back up the data as it was before anything runs, and is handed the
+// migrated data to persist afterwards.
+func migrate(store backend, dbData *DBData) error {
+	pending, err := pendingMigrations(dbData.SchemaVersion)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	from := dbData.SchemaVersion
+	err = store.backup(fmt.Sprintf("pre-migration-v%v", from))
+	if err != nil {
+		return err
+	}
+	applied, err := runMigrations(dbData)
+	if err != nil {
+		return err
+	}
+	for _, m := range applied {
+		log.Printf("Applied database migration %v: %v", m.Version, m.Name)
+	}
+	return store.compact(*dbData)
+}
+
+// DryRunMigrations reports which migrations would run against the database at
+// path without writing anything. The migrations are run against a copy of
+// the data to make sure they would succeed.
+func DryRunMigrations(path string, encryptionKey []byte) ([]Migration, error) {
+	s, err := newSealer(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(path+".lock", false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	dbData, _, err := readSnapshot(path, s)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = replayWAL(path+".wal", &dbData, s)
+	if err != nil {
+		return nil, err
+	}
+	return runMigrations(&dbData)
+}
+
+// backfillTimestamps gives every chirp and user without a created_at the
+// best guess there is. IDs are handed out in order, so a chirp can't be
+// newer than the oldest chirp with a higher ID that has a created_at, and a
+// user can't be newer than their first chirp. Anything still unknown gets
+// now. updated_at starts out as created_at, or when a chirp or user was
+// deleted if that is later.
+func backfillTimestamps(dbData *DBData, now time.Time) {
+	var ids []int
+	for id := range dbData.Chirps {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	bound := now
+	firstChirps := map[int]time.Time{}
+	for _, id := range ids {
+		chirp := dbData.Chirps[id]
+		if chirp.CreatedAt == nil {
+			createdAt := bound
+			chirp.CreatedAt = &createdAt
+		}
+		if chirp.CreatedAt.Before(bound) {
+			bound = *chirp.CreatedAt
+		}
+		if chirp.UpdatedAt == nil {
+			chirp.UpdatedAt = latest(*chirp.CreatedAt, chirp.DeletedAt)
+		}
+		firstChirps[chirp.AuthorID] = *chirp.CreatedAt
+		dbData.Chirps[id] = chirp
+	}
+	for id, user := range dbData.Users {
+		if user.CreatedAt == nil {
+			createdAt := now
+			if first, ok := firstChirps[id]; ok {
+				createdAt = first
+			}
+			user.CreatedAt = &createdAt
+		}
+		if user.UpdatedAt == nil {
+			user.UpdatedAt = latest(*user.CreatedAt, user.DeletedAt)
+		}
+		dbData.Users[id] = user
+	}
+}
+
+func latest(t time.Time, other *time.Time) *time.Time {
+	if other != nil && other.After(t) {
+		t = *other
+	}
+	return &t
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// legacyDB is a db.json as written before it had a schema_version.
+const legacyDB = `{"chirps":{"1":{"id":1,"body":"hi","author_id":1},"3":{"id":3,"body":"there","author_id":1}},"users":{"1":{"id":1,"email":"a@b.c","password":"h"}}}`
+
+func TestMigrations(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	err := os.WriteFile(path, []byte(legacyDB), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := DryRunMigrations(path, nil)
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatal(pending, err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != legacyDB {
+		t.Fatal("dry run changed db.json", string(raw))
+	}
+
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sequences were seeded from the IDs already in use
+	c, err := db.CreateChirp(ctx, "new", 1)
+	if err != nil || c.ID != 4 {
+		t.Fatal(c, err)
+	}
+	db.Close()
+
+	backups, err := filepath.Glob(path + ".pre-migration-v0.*")
+	if err != nil || len(backups) != 1 {
+		t.Fatal(backups, err)
+	}
+	if raw, _ := os.ReadFile(backups[0]); string(raw) != legacyDB {
+		t.Fatal("backup doesn't hold the data from before migrating", string(raw))
+	}
+	if pending, err := DryRunMigrations(path, nil); err != nil || len(pending) != 0 {
+		t.Fatal(pending, err)
+	}
+}
+
+func TestBackfillTimestamps(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	known := now.Add(-time.Hour)
+	dbData := &DBData{
+		Chirps: map[int]ChirpResource{
+			1: {ID: 1, AuthorID: 1},
+			2: {ID: 2, AuthorID: 1, CreatedAt: &known},
+			3: {ID: 3, AuthorID: 2},
+		},
+		Users: map[int]DetailedUserResource{
+			1: {ID: 1},
+			2: {ID: 2},
+			3: {ID: 3},
+		},
+	}
+	backfillTimestamps(dbData, now)
+
+	// A chirp can't be newer than one with a higher ID
+	for id, want := range map[int]time.Time{1: known, 2: known, 3: now} {
+		chirp := dbData.Chirps[id]
+		if !chirp.CreatedAt.Equal(want) || !chirp.UpdatedAt.Equal(want) {
+			t.Fatal(id, chirp.CreatedAt, chirp.UpdatedAt)
+		}
+	}
+	// Users joined no later than their first chirp
+	for id, want := range map[int]time.Time{1: known, 2: now, 3: now} {
+		if user := dbData.Users[id]; !user.CreatedAt.Equal(want) {
+			t.Fatal(id, user.CreatedAt)
+		}
+	}
+}
+
+func TestTimeFilters(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	err := os.WriteFile(path, []byte(legacyDB), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Backfilled chirps sort before anything posted after the migration
+	mark := time.Now().UTC().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	db.CreateChirp(ctx, "new", 1)
+
+	for _, tc := range []struct {
+		op   Op
+		want int
+	}{
+		{Gte, 1},
+		{Lte, 2},
+	} {
+		page, err := db.QueryChirps(NewQuery().Where("created_at", tc.op, mark.Format(time.RFC3339Nano)))
+		if err != nil || len(page.Items) != tc.want {
+			t.Fatal(tc.op, page, err)
+		}
+	}
+	if _, err := db.QueryChirps(NewQuery().Where("created_at", Gte, "yesterday")); err == nil {
+		t.Fatal("bad timestamp accepted")
+	}
+}
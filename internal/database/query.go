@@ -0,0 +1,543 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Op is how a Filter compares a field with its value.
+type Op string
+
+const (
+	Eq  Op = "eq"
+	Ne  Op = "ne"
+	Lt  Op = "lt"
+	Lte Op = "lte"
+	Gt  Op = "gt"
+	Gte Op = "gte"
+	// In matches if the field equals any of the values in a slice.
+	In Op = "in"
+	// Contains matches strings holding the value, ignoring case.
+	Contains Op = "contains"
+)
+
+type filter struct {
+	field string
+	op    Op
+	value any
+}
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// Query selects, orders and pages through records. Build one from
+// NewQuery, every method returns a changed copy so queries can be shared
+// and extended freely. Records are always ordered by id last, so the order
+// is total and cursors are stable.
+type Query struct {
+	filters []filter
+	sort    []sortKey
+	limit   int
+	offset  int
+	cursor  string
+}
+
+// Page is one page of query results.
+type Page[T any] struct {
+	Items []T
+	// NextCursor continues the query after the last of Items. It is empty
+	// when there is nothing after them.
+	NextCursor string
+}
+
+func NewQuery() Query {
+	return Query{}
+}
+
+// Where narrows the query down to records whose field compares to value as
+// op says. Records have to match every filter. value can be given as the
+// field's own type or as a string, e.g. "3" for an int field or an RFC 3339
+// time for a time field.
+func (q Query) Where(field string, op Op, value any) Query {
+	q.filters = append(q.filters[:len(q.filters):len(q.filters)], filter{field: field, op: op, value: value})
+	return q
+}
+
+// OrderBy adds sort keys, earlier ones taking precedence. A leading "-"
+// sorts by that field descending, e.g. OrderBy("-created_at", "body").
+func (q Query) OrderBy(fields ...string) Query {
+	q.sort = q.sort[:len(q.sort):len(q.sort)]
+	for _, field := range fields {
+		name, desc := strings.CutPrefix(field, "-")
+		q.sort = append(q.sort, sortKey{field: name, desc: desc})
+	}
+	return q
+}
+
+// Limit caps how many records a page holds. Zero or less means no limit.
+func (q Query) Limit(n int) Query {
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n records, counted after the cursor if there is
+// one.
+func (q Query) Offset(n int) Query {
+	q.offset = n
+	return q
+}
+
+// After continues from the NextCursor of an earlier page. The query has to
+// be sorted the same way as the one the cursor came from.
+func (q Query) After(cursor string) Query {
+	q.cursor = cursor
+	return q
+}
+
+// kind is the type of a queryable field. Values of a field are normalized
+// to int64, string, time.Time or bool, or nil if the record has none.
+type kind int
+
+const (
+	kindInt kind = iota
+	kindString
+	kindTime
+	kindBool
+)
+
+type field[T any] struct {
+	kind kind
+	get  func(T) any
+}
+
+func intField[T any](get func(T) int) field[T] {
+	return field[T]{kind: kindInt, get: func(item T) any { return int64(get(item)) }}
+}
+
+func stringField[T any](get func(T) string) field[T] {
+	return field[T]{kind: kindString, get: func(item T) any { return get(item) }}
+}
+
+func boolField[T any](get func(T) bool) field[T] {
+	return field[T]{kind: kindBool, get: func(item T) any { return get(item) }}
+}
+
+func timeField[T any](get func(T) *time.Time) field[T] {
+	return field[T]{kind: kindTime, get: func(item T) any {
+		t := get(item)
+		if t == nil {
+			return nil
+		}
+		return *t
+	}}
+}
+
+var chirpFields = map[string]field[ChirpResource]{
+	"id":         intField(func(c ChirpResource) int { return c.ID }),
+	"author_id":  intField(func(c ChirpResource) int { return c.AuthorID }),
+	"body":       stringField(func(c ChirpResource) string { return c.Body }),
+	"public_id":  stringField(func(c ChirpResource) string { return c.PublicID }),
+	"created_at": timeField(func(c ChirpResource) *time.Time { return c.CreatedAt }),
+	"updated_at": timeField(func(c ChirpResource) *time.Time { return c.UpdatedAt }),
+}
+
+var userFields = map[string]field[DetailedUserResource]{
+	"id":            intField(func(u DetailedUserResource) int { return u.ID }),
+	"email":         stringField(func(u DetailedUserResource) string { return u.Email }),
+	"public_id":     stringField(func(u DetailedUserResource) string { return u.PublicID }),
+	"is_chirpy_red": boolField(func(u DetailedUserResource) bool { return u.IsChirpyRed }),
+	"created_at":    timeField(func(u DetailedUserResource) *time.Time { return u.CreatedAt }),
+	"updated_at":    timeField(func(u DetailedUserResource) *time.Time { return u.UpdatedAt }),
+}
+
+// QueryChirps runs q over every chirp that is visible, i.e. not in the
+// trash and not written by a deleted user.
+func (db *DB) QueryChirps(q Query) (Page[ChirpResource], error) {
+	var page Page[ChirpResource]
+	err := db.View(func(tx *Tx) error {
+		var chirps []ChirpResource
+		if authorID, ok := equalTo(q, chirpFields, "author_id"); ok {
+			chirps = tx.ChirpsByAuthor(int(authorID.(int64)))
+		} else {
+			chirps = tx.Chirps()
+		}
+		var err error
+		page, err = runQuery(tx.visibleChirps(chirps), chirpFields, q)
+		return err
+	})
+	return page, err
+}
+
+// QueryUsers runs q over every user that hasn't deleted their account.
+func (db *DB) QueryUsers(q Query) (Page[UserResource], error) {
+	var detailed Page[DetailedUserResource]
+	err := db.View(func(tx *Tx) error {
+		var users []DetailedUserResource
+		for _, user := range tx.Users() {
+			if !user.Deleted() {
+				users = append(users, user)
+			}
+		}
+		var err error
+		detailed, err = runQuery(users, userFields, q)
+		return err
+	})
+	if err != nil {
+		return Page[UserResource]{}, err
+	}
+	page := Page[UserResource]{NextCursor: detailed.NextCursor}
+	for _, user := range detailed.Items {
+		page.Items = append(page.Items, toUserResource(user))
+	}
+	return page, nil
+}
+
+// equalTo returns the value q requires the named field to be equal to, if
+// any, so an index can be used to find the candidates.
+func equalTo[T any](q Query, fields map[string]field[T], name string) (any, bool) {
+	for _, f := range q.filters {
+		if f.field != name || f.op != Eq {
+			continue
+		}
+		value, err := normalize(fields[name].kind, f.value)
+		if err == nil {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// boundFilter is a filter checked against the fields it can be used on.
+type boundFilter[T any] struct {
+	field  field[T]
+	op     Op
+	values []any
+}
+
+func runQuery[T any](items []T, fields map[string]field[T], q Query) (Page[T], error) {
+	var filters []boundFilter[T]
+	for _, f := range q.filters {
+		bound, err := bindFilter(fields, f)
+		if err != nil {
+			return Page[T]{}, err
+		}
+		filters = append(filters, bound)
+	}
+	keys, err := sortKeys(fields, q.sort)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	var matched []T
+	for _, item := range items {
+		if matchesAll(item, filters) {
+			matched = append(matched, item)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compareKeys(keys, keyValues(fields, keys, matched[i]), keyValues(fields, keys, matched[j])) < 0
+	})
+
+	start := 0
+	if q.cursor != "" {
+		after, err := decodeCursor(fields, keys, q.cursor)
+		if err != nil {
+			return Page[T]{}, err
+		}
+		start = sort.Search(len(matched), func(i int) bool {
+			return compareKeys(keys, keyValues(fields, keys, matched[i]), after) > 0
+		})
+	}
+	start = min(start+max(q.offset, 0), len(matched))
+	end := len(matched)
+	if q.limit > 0 {
+		end = min(start+q.limit, end)
+	}
+
+	page := Page[T]{Items: matched[start:end]}
+	if end < len(matched) && end > start {
+		page.NextCursor, err = encodeCursor(keys, keyValues(fields, keys, matched[end-1]))
+		if err != nil {
+			return Page[T]{}, err
+		}
+	}
+	return page, nil
+}
+
+func bindFilter[T any](fields map[string]field[T], filter filter) (boundFilter[T], error) {
+	f, ok := fields[filter.field]
+	if !ok {
+		return boundFilter[T]{}, newError(ErrInvalid, fmt.Sprintf("Can't filter by %v", filter.field))
+	}
+	bound := boundFilter[T]{field: f, op: filter.op}
+	raw := []any{filter.value}
+	switch filter.op {
+	case Eq, Ne, Lt, Lte, Gt, Gte:
+	case Contains:
+		if f.kind != kindString {
+			return bound, newError(ErrInvalid, fmt.Sprintf("Can't search for text in %v", filter.field))
+		}
+	case In:
+		list := reflect.ValueOf(filter.value)
+		if list.Kind() != reflect.Slice {
+			return bound, newError(ErrInvalid, fmt.Sprintf("Filter on %v needs a list of values", filter.field))
+		}
+		raw = nil
+		for i := 0; i < list.Len(); i++ {
+			raw = append(raw, list.Index(i).Interface())
+		}
+	default:
+		return bound, newError(ErrInvalid, fmt.Sprintf("Unknown filter %v", filter.op))
+	}
+	for _, value := range raw {
+		normalized, err := normalize(f.kind, value)
+		if err != nil {
+			return bound, newError(ErrInvalid, fmt.Sprintf("Invalid value %v for %v", value, filter.field))
+		}
+		bound.values = append(bound.values, normalized)
+	}
+	return bound, nil
+}
+
+// normalize turns a filter value into the representation fields of kind k
+// have.
+func normalize(k kind, value any) (any, error) {
+	s, isString := value.(string)
+	switch k {
+	case kindInt:
+		if isString {
+			n, err := strconv.ParseInt(s, 10, 64)
+			return n, err
+		}
+		v := reflect.ValueOf(value)
+		if v.CanInt() {
+			return v.Int(), nil
+		}
+	case kindString:
+		if isString {
+			return s, nil
+		}
+	case kindTime:
+		if isString {
+			t, err := time.Parse(time.RFC3339, s)
+			return t, err
+		}
+		if t, ok := value.(time.Time); ok {
+			return t, nil
+		}
+	case kindBool:
+		if isString {
+			b, err := strconv.ParseBool(s)
+			return b, err
+		}
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %T", value)
+}
+
+func matchesAll[T any](item T, filters []boundFilter[T]) bool {
+	for _, filter := range filters {
+		if !filter.matches(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches never matches a record that has no value for the field, except
+// for Ne.
+func (filter boundFilter[T]) matches(item T) bool {
+	value := filter.field.get(item)
+	if value == nil {
+		return filter.op == Ne
+	}
+	if filter.op == In {
+		for _, v := range filter.values {
+			if compareValues(value, v) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c := compareValues(value, filter.values[0])
+	switch filter.op {
+	case Eq:
+		return c == 0
+	case Ne:
+		return c != 0
+	case Lt:
+		return c < 0
+	case Lte:
+		return c <= 0
+	case Gt:
+		return c > 0
+	case Gte:
+		return c >= 0
+	case Contains:
+		return strings.Contains(strings.ToLower(value.(string)), strings.ToLower(filter.values[0].(string)))
+	}
+	return false
+}
+
+// sortKeys checks keys against fields, and adds id as the final tiebreaker.
+func sortKeys[T any](fields map[string]field[T], keys []sortKey) ([]sortKey, error) {
+	for _, key := range keys {
+		if _, ok := fields[key.field]; !ok {
+			return nil, newError(ErrInvalid, fmt.Sprintf("Can't sort by %v", key.field))
+		}
+		if key.field == "id" {
+			return keys, nil
+		}
+	}
+	return append(keys[:len(keys):len(keys)], sortKey{field: "id"}), nil
+}
+
+func keyValues[T any](fields map[string]field[T], keys []sortKey, item T) []any {
+	values := make([]any, len(keys))
+	for idx, key := range keys {
+		values[idx] = fields[key.field].get(item)
+	}
+	return values
+}
+
+func compareKeys(keys []sortKey, a, b []any) int {
+	for idx, key := range keys {
+		c := compareValues(a[idx], b[idx])
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareValues orders two normalized values of the same kind. A missing
+// value comes before any other.
+func compareValues(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// cursor is what a NextCursor holds: the sort key values of the last record
+// on the page, and the sort order they are for.
+type cursor struct {
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+func sortSignature(keys []sortKey) string {
+	var parts []string
+	for _, key := range keys {
+		if key.desc {
+			parts = append(parts, "-"+key.field)
+			continue
+		}
+		parts = append(parts, key.field)
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeCursor(keys []sortKey, values []any) (string, error) {
+	c := cursor{Sort: sortSignature(keys)}
+	for _, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, data)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+var errInvalidCursor = newError(ErrInvalid, "Invalid cursor")
+
+func decodeCursor[T any](fields map[string]field[T], keys []sortKey, s string) ([]any, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	c := cursor{}
+	err = json.Unmarshal(data, &c)
+	if err != nil || len(c.Values) != len(keys) {
+		return nil, errInvalidCursor
+	}
+	if c.Sort != sortSignature(keys) {
+		return nil, newError(ErrInvalid, "Cursor is for a different sort order")
+	}
+	values := make([]any, len(keys))
+	for idx, key := range keys {
+		if string(c.Values[idx]) == "null" {
+			continue
+		}
+		var value any
+		switch fields[key.field].kind {
+		case kindInt:
+			var n int64
+			err = json.Unmarshal(c.Values[idx], &n)
+			value = n
+		case kindString:
+			var s string
+			err = json.Unmarshal(c.Values[idx], &s)
+			value = s
+		case kindTime:
+			var t time.Time
+			err = json.Unmarshal(c.Values[idx], &t)
+			value = t
+		case kindBool:
+			var b bool
+			err = json.Unmarshal(c.Values[idx], &b)
+			value = b
+		}
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	u1, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	u2, _ := db.CreateUsers(ctx, "d@b.c", "h")
+	for i := 0; i < 10; i++ {
+		author := u1.ID
+		if i%3 == 0 {
+			author = u2.ID
+		}
+		db.CreateChirp(ctx, fmt.Sprintf("Chirp %d", i%4), author)
+	}
+	page, err := db.QueryChirps(NewQuery().Where("author_id", Eq, u2.ID).OrderBy("-id"))
+	if err != nil || len(page.Items) != 4 || page.Items[0].ID != 10 || page.NextCursor != "" {
+		t.Fatal(page, err)
+	}
+	q := NewQuery().OrderBy("body", "-id").Limit(3)
+	var ids []int
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, err := db.QueryChirps(q.After(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page.Items {
+			ids = append(ids, c.ID)
+		}
+		if page.NextCursor == "" {
+			if pages != 3 {
+				t.Fatal(pages)
+			}
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if fmt.Sprint(ids) != "[9 5 1 10 6 2 7 3 8 4]" {
+		t.Fatal(ids)
+	}
+	page, _ = db.QueryChirps(NewQuery().Where("id", In, []int{2, 4, 99}).Where("body", Contains, "chirp"))
+	if len(page.Items) != 2 {
+		t.Fatal(page)
+	}
+	page, _ = db.QueryChirps(NewQuery().Where("id", In, []int{}))
+	if len(page.Items) != 0 {
+		t.Fatal(page)
+	}
+	page, _ = db.QueryChirps(NewQuery().Where("id", Gt, "7").Offset(1))
+	if len(page.Items) != 2 || page.Items[0].ID != 9 {
+		t.Fatal(page)
+	}
+	if _, err := db.QueryChirps(NewQuery().OrderBy("id").After(cursor)); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	if _, err := db.QueryChirps(NewQuery().After("garbage")); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	if _, err := db.QueryChirps(NewQuery().OrderBy("nope")); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	if _, err := db.QueryChirps(NewQuery().Where("created_at", Lt, time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrFollower is returned for every change made to a follower, other than
+// the ones it replicates from its leader.
+var ErrFollower = newError(ErrConflict, "This server is a read-only follower, make changes on its leader")
+
+// ErrOutOfSync means changes from the leader don't follow on from what a
+// follower has, and it has to start over from a ReplicationSnapshot.
+var ErrOutOfSync = newError(ErrConflict, "Follower is out of sync with its leader, resync from a snapshot")
+
+type replicatingKey struct{}
+
+// SetFollower makes the DB a read-only follower that only takes changes
+// through ApplyChanges and LoadReplicationSnapshot, or makes it writable
+// again, e.g. when a follower is promoted to leader.
+func (db *DB) SetFollower(follower bool) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	db.follower = follower
+}
+
+// Follower reports whether the DB is a read-only follower.
+func (db *DB) Follower() bool {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return db.follower
+}
+
+// writableBy fails with ErrFollower unless ctx carries changes from the
+// leader. Call with db.mux held.
+func (db *DB) writableBy(ctx context.Context) error {
+	if db.follower && ctx.Value(replicatingKey{}) == nil {
+		return ErrFollower
+	}
+	return nil
+}
+
+// ReplicationSnapshot returns all of the data for a follower to start from,
+// as of the change numbered by the returned sequence.
+func (db *DB) ReplicationSnapshot() ([]byte, int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	data, err := json.Marshal(db.data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, db.data.Sequences[entityChange], nil
+}
+
+// LoadReplicationSnapshot replaces the whole database with a snapshot taken
+// by ReplicationSnapshot on the leader, migrating it first if the leader
+// runs an older schema.
+func (db *DB) LoadReplicationSnapshot(ctx context.Context, raw []byte) error {
+	dbData := DBData{}
+	err := json.Unmarshal(raw, &dbData)
+	if err != nil {
+		return newError(ErrInvalid, "Replication snapshot is not valid: "+err.Error())
+	}
+	fillEmptyMaps(&dbData)
+	_, err = runMigrations(&dbData)
+	if err != nil {
+		return newError(ErrInvalid, "Replication snapshot can't be migrated: "+err.Error())
+	}
+
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.replaceData(ctx, "LoadReplicationSnapshot", "", dbData)
+}
+
+// ApplyChanges replays change events made on the leader, which have to
+// follow on from LastChangeSeq without a gap. They get the same sequence
+// numbers here as on the leader, so the follower's own change events, and
+// any consumer of them, mirror the leader's.
+func (db *DB) ApplyChanges(ctx context.Context, events []Event) error {
+	ctx = context.WithValue(ctx, replicatingKey{}, true)
+	return db.UpdateContext(ctx, "ApplyChanges", func(tx *Tx) error {
+		last := tx.data.Sequences[entityChange]
+		next := last + 1
+		for _, event := range events {
+			if event.Seq != next {
+				return ErrOutOfSync
+			}
+			err := tx.applyEvent(event)
+			if err != nil {
+				return fmt.Errorf("applying change %v: %w", event.Seq, err)
+			}
+			// Each event has to come out as exactly one here, or the
+			// sequence numbers would drift from the leader's.
+			if len(tx.events) != next-last {
+				return ErrOutOfSync
+			}
+			tx.events[len(tx.events)-1].Time = event.Time
+			next++
+		}
+		return nil
+	})
+}
+
+// applyEvent makes the change described by a leader's event.
+func (tx *Tx) applyEvent(e Event) error {
+	switch e.Entity {
+	case entityChirp:
+		id, err := strconv.Atoi(e.Key)
+		if err != nil {
+			return err
+		}
+		if e.Op == OpDelete {
+			return tx.DeleteChirp(id)
+		}
+		_, chirp, err := DecodeEvent[ChirpResource](e)
+		if err != nil || chirp == nil {
+			return ErrOutOfSync
+		}
+		err = tx.seenID(entityChirp, chirp.ID)
+		if err != nil {
+			return err
+		}
+		return tx.PutChirp(*chirp)
+	case entityUser:
+		id, err := strconv.Atoi(e.Key)
+		if err != nil {
+			return err
+		}
+		if e.Op == OpDelete {
+			return tx.DeleteUser(id)
+		}
+		_, user, err := DecodeEvent[DetailedUserResource](e)
+		if err != nil || user == nil {
+			return ErrOutOfSync
+		}
+		err = tx.seenID(entityUser, user.ID)
+		if err != nil {
+			return err
+		}
+		return tx.PutUser(*user)
+	case entityRevocation:
+		if e.Op == OpDelete {
+			return tx.DeleteRevocation(e.Key)
+		}
+		_, revocation, err := DecodeEvent[Revocation](e)
+		if err != nil || revocation == nil {
+			return ErrOutOfSync
+		}
+		return tx.PutRevocation(e.Key, *revocation)
+	case entityHold:
+		before, after, err := DecodeEvent[LegalHold](e)
+		if err != nil {
+			return ErrOutOfSync
+		}
+		if e.Op == OpDelete {
+			if before == nil {
+				return ErrOutOfSync
+			}
+			return tx.DeleteHold(before.Entity, before.ID)
+		}
+		if after == nil {
+			return ErrOutOfSync
+		}
+		return tx.PutHold(*after)
+	case entityRevision:
+		id, err := strconv.Atoi(e.Key)
+		if err != nil {
+			return err
+		}
+		if e.Op == OpDelete {
+			return tx.DeleteRevisions(id)
+		}
+		_, history, err := DecodeEvent[ChirpHistory](e)
+		if err != nil || history == nil {
+			return ErrOutOfSync
+		}
+		return tx.PutRevisions(*history)
+	}
+	return fmt.Errorf("unknown entity %v", e.Entity)
+}
+
+// seenID keeps the sequence for entity at or past an ID handed out by the
+// leader, so a promoted follower never hands it out again.
+func (tx *Tx) seenID(entity string, id int) error {
+	if id <= tx.data.Sequences[entity] {
+		return nil
+	}
+	return tx.setSequence(entity, id)
+}
+
+// replaceData swaps in dbData for the whole database and starts the change
+// events over from its change sequence. Call with db.flushMux and db.mux
+// held.
+func (db *DB) replaceData(ctx context.Context, action string, note string, dbData DBData) error {
+	err := db.store.compact(dbData)
+	if err != nil {
+		return err
+	}
+	db.data = dbData
+	db.ix = buildIndexes(dbData)
+	db.pending = nil
+	db.pendingEvents = nil
+	err = db.audit(ctx, action, note, nil, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	db.changes.reset(dbData.Sequences[entityChange])
+	return db.store.resetChanges()
+}
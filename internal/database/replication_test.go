@@ -0,0 +1,52 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	leader := NewMemoryDB(Options{})
+	defer leader.Close()
+	f := NewMemoryDB(Options{})
+	defer f.Close()
+	u, _ := leader.CreateUsers(ctx, "a@b.c", "x")
+	snapshot, _, _ := leader.ReplicationSnapshot()
+	f.SetFollower(true)
+	if err := f.LoadReplicationSnapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := leader.CreateChirp(ctx, "hi", u.ID)
+	leader.PlaceHold(ctx, EntityChirp, c.ID, "r")
+	leader.ReleaseHold(ctx, EntityChirp, c.ID)
+	leader.DeleteUser(ctx, u.ID)
+	events, _ := leader.Changes(f.LastChangeSeq(), 0)
+	if err := f.ApplyChanges(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	if f.LastChangeSeq() != leader.LastChangeSeq() {
+		t.Fatal(f.LastChangeSeq(), leader.LastChangeSeq())
+	}
+	applied, _ := f.Changes(1, 0)
+	if len(applied) != len(events) || !applied[0].Time.Equal(events[0].Time) {
+		t.Fatal(applied, events)
+	}
+	if err := f.ApplyChanges(ctx, events); !errors.Is(err, ErrOutOfSync) {
+		t.Fatal(err)
+	}
+	if _, err := f.CreateUsers(ctx, "z@b.c", "x"); !errors.Is(err, ErrFollower) {
+		t.Fatal(err)
+	}
+
+	// Once promoted, it carries on from the IDs the leader handed out
+	f.SetFollower(false)
+	u2, err := f.CreateUsers(ctx, "z@b.c", "x")
+	if err != nil || u2.ID != 2 {
+		t.Fatal(u2, err)
+	}
+	c2, err := f.CreateChirp(ctx, "x", u2.ID)
+	if err != nil || c2.ID != 2 {
+		t.Fatal(c2, err)
+	}
+}
@@ -0,0 +1,355 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the retention rules.
+const (
+	RuleRevocations  = "revocations"
+	RuleTrash        = "trash"
+	RuleChirps       = "chirps"
+	RuleDeletedUsers = "deleted-users"
+)
+
+// RetentionRule purges data once it is older than MaxAge. What the age is
+// measured from depends on the rule:
+//
+//   - revocations: revoked refresh tokens, from when the token expired
+//   - trash: chirps in the trash, from when they were deleted
+//   - chirps: every chirp, from when it was created
+//   - deleted-users: deleted users along with all their chirps, from when
+//     the user was deleted
+//
+// Users and chirps under a LegalHold are never purged.
+type RetentionRule struct {
+	Name   string
+	MaxAge time.Duration
+}
+
+// retentionFuncs purge what a rule covers that is older than cutoff.
+var retentionFuncs = map[string]func(p *purge, cutoff time.Time) error{
+	RuleRevocations:  purgeRevocations,
+	RuleTrash:        purgeTrash,
+	RuleChirps:       purgeChirps,
+	RuleDeletedUsers: purgeDeletedUsers,
+}
+
+// DefaultRetentionRules drop revocations as soon as their token expires,
+// and trashed chirps and deleted users after 30 days. Chirps are kept
+// forever.
+func DefaultRetentionRules() []RetentionRule {
+	return []RetentionRule{
+		{Name: RuleRevocations, MaxAge: 0},
+		{Name: RuleTrash, MaxAge: 30 * 24 * time.Hour},
+		{Name: RuleDeletedUsers, MaxAge: 30 * 24 * time.Hour},
+	}
+}
+
+// ParseRetentionRules reads a comma separated list of name=age pairs, e.g.
+// "chirps=365d,trash=7d", and applies it on top of DefaultRetentionRules.
+// Ages are Go durations or a number of days like "30d", and "off" disables
+// a rule.
+func ParseRetentionRules(spec string) ([]RetentionRule, error) {
+	rules := DefaultRetentionRules()
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, age, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, newError(ErrInvalid, fmt.Sprintf("Retention rule %v is not of the form name=age", pair))
+		}
+		if _, ok := retentionFuncs[name]; !ok {
+			return nil, newError(ErrInvalid, fmt.Sprintf("Unknown retention rule %v", name))
+		}
+		idx := -1
+		for i, rule := range rules {
+			if rule.Name == name {
+				idx = i
+			}
+		}
+		if age == "off" {
+			if idx >= 0 {
+				rules = append(rules[:idx], rules[idx+1:]...)
+			}
+			continue
+		}
+		maxAge, err := parseAge(age)
+		if err != nil {
+			return nil, newError(ErrInvalid, fmt.Sprintf("Invalid age %v for retention rule %v", age, name))
+		}
+		if idx >= 0 {
+			rules[idx].MaxAge = maxAge
+			continue
+		}
+		rules = append(rules, RetentionRule{Name: name, MaxAge: maxAge})
+	}
+	return rules, nil
+}
+
+func parseAge(age string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err == nil && d < 0 {
+		return 0, errors.New("negative age")
+	}
+	return d, err
+}
+
+func (db *DB) retentionRules() []RetentionRule {
+	if db.opts.Retention == nil {
+		return DefaultRetentionRules()
+	}
+	return db.opts.Retention
+}
+
+// RetentionReport tells what one rule purged in one run.
+type RetentionReport struct {
+	Rule   string `json:"rule"`
+	MaxAge string `json:"max_age"`
+	DryRun bool   `json:"dry_run"`
+	// Purged counts the records purged, or that would have been on a dry
+	// run. Purging a deleted user counts their chirps as well.
+	Purged int `json:"purged"`
+	// Held counts the users and chirps that were due but are under a legal
+	// hold.
+	Held int `json:"held"`
+	// Keys names what would have been purged on a dry run, like "chirp:12",
+	// up to maxReportKeys of them.
+	Keys  []string `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+const maxReportKeys = 100
+
+// purge tallies up what a rule purges into its report, and purges it unless
+// this is a dry run.
+type purge struct {
+	tx     *Tx
+	report *RetentionReport
+}
+
+func (p *purge) count(entity string, key string) {
+	p.report.Purged++
+	if p.report.DryRun && len(p.report.Keys) < maxReportKeys {
+		p.report.Keys = append(p.report.Keys, entity+":"+key)
+	}
+}
+
+func (p *purge) held() {
+	p.report.Held++
+}
+
+func (p *purge) chirp(id int) error {
+	p.count(entityChirp, strconv.Itoa(id))
+	if p.report.DryRun {
+		return nil
+	}
+	err := p.tx.DeleteChirp(id)
+	if err != nil {
+		return err
+	}
+	return p.tx.DeleteRevisions(id)
+}
+
+func (p *purge) user(id int) error {
+	p.count(entityUser, strconv.Itoa(id))
+	if p.report.DryRun {
+		return nil
+	}
+	return p.tx.DeleteUser(id)
+}
+
+func (p *purge) revocation(hash string) error {
+	p.count(entityRevocation, hash)
+	if p.report.DryRun {
+		return nil
+	}
+	return p.tx.DeleteRevocation(hash)
+}
+
+func purgeRevocations(p *purge, cutoff time.Time) error {
+	for hash, revocation := range p.tx.data.Revocations {
+		if revocation.ExpiresAt > cutoff.Unix() {
+			continue
+		}
+		err := p.revocation(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeTrash(p *purge, cutoff time.Time) error {
+	for _, chirp := range p.tx.Chirps() {
+		if !chirp.Trashed() || chirp.DeletedAt.After(cutoff) {
+			continue
+		}
+		if p.tx.chirpHeld(chirp) {
+			p.held()
+			continue
+		}
+		err := p.chirp(chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeChirps(p *purge, cutoff time.Time) error {
+	for _, chirp := range p.tx.Chirps() {
+		if chirp.CreatedAt == nil || chirp.CreatedAt.After(cutoff) {
+			continue
+		}
+		if p.tx.chirpHeld(chirp) {
+			p.held()
+			continue
+		}
+		err := p.chirp(chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeDeletedUsers(p *purge, cutoff time.Time) error {
+	for _, user := range p.tx.Users() {
+		if !user.Deleted() || user.DeletedAt.After(cutoff) {
+			continue
+		}
+		if p.tx.userHeld(user.ID) {
+			p.held()
+			continue
+		}
+		for _, chirp := range p.tx.ChirpsByAuthor(user.ID) {
+			err := p.chirp(chirp.ID)
+			if err != nil {
+				return err
+			}
+		}
+		err := p.user(user.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyRetention applies every retention rule as of now, each in a
+// transaction of its own, and reports what each of them purged. On a dry
+// run nothing is purged and the reports tell what would have been, so a
+// chirp two rules would purge is reported by both. A rule that fails
+// doesn't stop the ones after it, their errors are returned together.
+func (db *DB) ApplyRetention(ctx context.Context, now time.Time, dryRun bool) ([]RetentionReport, error) {
+	var reports []RetentionReport
+	var errs []error
+	for _, rule := range db.retentionRules() {
+		report := RetentionReport{Rule: rule.Name, MaxAge: rule.MaxAge.String(), DryRun: dryRun}
+		apply := func(tx *Tx) error {
+			return retentionFuncs[rule.Name](&purge{tx: tx, report: &report}, now.Add(-rule.MaxAge))
+		}
+		var err error
+		if dryRun {
+			err = db.View(apply)
+		} else {
+			err = db.update(ctx, "ApplyRetention", rule.Name, apply)
+		}
+		if err != nil {
+			report.Error = err.Error()
+			errs = append(errs, fmt.Errorf("retention rule %v: %w", rule.Name, err))
+		}
+		db.retention.record(report, now)
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+// logRetention logs what a scheduled run of the retention rules did. Dry
+// runs are always logged, as that is all they do.
+func logRetention(reports []RetentionReport) {
+	for _, report := range reports {
+		if report.DryRun {
+			log.Printf("Retention dry run: %v would purge %d, %d held", report.Rule, report.Purged, report.Held)
+			continue
+		}
+		if report.Purged > 0 || report.Held > 0 {
+			log.Printf("Retention: %v purged %d, %d held", report.Rule, report.Purged, report.Held)
+		}
+	}
+}
+
+// RetentionStats are the running totals of one rule since the DB was
+// opened. Purged only counts what was actually purged, not dry runs.
+type RetentionStats struct {
+	Rule       string           `json:"rule"`
+	MaxAge     string           `json:"max_age"`
+	Runs       int              `json:"runs"`
+	DryRuns    int              `json:"dry_runs"`
+	Purged     int              `json:"purged"`
+	Failures   int              `json:"failures"`
+	LastRun    *time.Time       `json:"last_run,omitempty"`
+	LastReport *RetentionReport `json:"last_report,omitempty"`
+}
+
+type retentionStats struct {
+	mux   *sync.Mutex
+	rules map[string]RetentionStats
+}
+
+func newRetentionStats() *retentionStats {
+	return &retentionStats{mux: &sync.Mutex{}, rules: map[string]RetentionStats{}}
+}
+
+func (s *retentionStats) record(report RetentionReport, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := s.rules[report.Rule]
+	switch {
+	case report.Error != "":
+		stats.Failures++
+	case report.DryRun:
+		stats.DryRuns++
+	default:
+		stats.Runs++
+		stats.Purged += report.Purged
+	}
+	lastRun := now.UTC()
+	stats.LastRun = &lastRun
+	stats.LastReport = &report
+	s.rules[report.Rule] = stats
+}
+
+// RetentionStats returns the stats of every retention rule, in the order
+// the rules are applied.
+func (db *DB) RetentionStats() []RetentionStats {
+	db.retention.mux.Lock()
+	defer db.retention.mux.Unlock()
+
+	var stats []RetentionStats
+	for _, rule := range db.retentionRules() {
+		ruleStats := db.retention.rules[rule.Name]
+		ruleStats.Rule = rule.Name
+		ruleStats.MaxAge = rule.MaxAge.String()
+		stats = append(stats, ruleStats)
+	}
+	return stats
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	rules, err := ParseRetentionRules("chirps=2d,trash=off,deleted-users=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseRetentionRules("bogus=1d"); err == nil {
+		t.Fatal("bogus accepted")
+	}
+	db := NewMemoryDB(Options{Retention: rules})
+	defer db.Close()
+	u1, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	u2, _ := db.CreateUsers(ctx, "d@b.c", "h")
+	c1, _ := db.CreateChirp(ctx, "one", u1.ID)
+	c2, _ := db.CreateChirp(ctx, "two", u1.ID)
+	c3, _ := db.CreateChirp(ctx, "three", u2.ID)
+	if _, err := db.PlaceHold(ctx, EntityChirp, c2.ID, "case 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteChirp(ctx, c1.ID, u1.ID); err != nil {
+		t.Fatal(err)
+	}
+	// trash is off, so the chirp stays restorable
+	if trash, _ := db.GetTrash(u1.ID); len(trash) != 1 {
+		t.Fatal(trash)
+	}
+	if err := db.DeleteUser(ctx, u2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUser(u2.ID); err == nil {
+		t.Fatal("deleted user visible")
+	}
+	if _, err := db.GetChirp(c3.ID); err == nil {
+		t.Fatal("deleted user's chirp visible")
+	}
+	if _, err := db.CreateChirp(ctx, "x", u2.ID); err == nil {
+		t.Fatal("deleted user chirped")
+	}
+	later := time.Now().Add(3 * 24 * time.Hour)
+	reports, err := db.ApplyRetention(ctx, later, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := db.RetentionStats()
+	if len(stats) != 3 || stats[2].Rule != "chirps" || stats[2].DryRuns != 1 || stats[2].Purged != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	chirps, _ := db.GetChirps()
+	if len(chirps) != 1 {
+		t.Fatal(chirps)
+	}
+	reports, err = db.ApplyRetention(ctx, later, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revocations, deleted-users, chirps
+	if reports[1].Purged != 2 || reports[2].Purged != 1 || reports[2].Held != 1 {
+		t.Fatalf("%+v", reports)
+	}
+	if _, err := db.GetChirp(c2.ID); err != nil {
+		t.Fatal("held chirp purged")
+	}
+	if err := db.ReleaseHold(ctx, EntityChirp, c2.ID); err != nil {
+		t.Fatal(err)
+	}
+	db.ApplyRetention(ctx, later, false)
+	if _, err := db.GetChirp(c2.ID); err == nil {
+		t.Fatal("released chirp kept")
+	}
+	entries, _ := db.AuditLog(AuditQuery{})
+	if len(entries) == 0 || entries[0].Action != "ApplyRetention" {
+		t.Fatalf("%+v", entries)
+	}
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// ChirpRevision is a body a chirp had before it was edited.
+type ChirpRevision struct {
+	Revision int    `json:"revision"`
+	Body     string `json:"body"`
+	// CreatedAt is when the chirp was posted or edited to have this body.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChirpHistory is every earlier body of an edited chirp, oldest first.
+type ChirpHistory struct {
+	ChirpID   int             `json:"chirp_id"`
+	Revisions []ChirpRevision `json:"revisions"`
+}
+
+// editable reports whether a chirp is still within the edit window at now.
+func (db *DB) editable(chirp ChirpResource, now time.Time) bool {
+	if db.opts.EditWindow <= 0 || chirp.CreatedAt == nil {
+		return false
+	}
+	return now.Before(chirp.CreatedAt.Add(db.opts.EditWindow))
+}
+
+// EditChirp changes the body of a chirp, keeping the one it had as a
+// revision. Only its author can, and only within the edit window.
+func (db *DB) EditChirp(ctx context.Context, chirpID int, userId int, body string) (ChirpResource, error) {
+	var chirp ChirpResource
+	err := db.UpdateContext(ctx, "EditChirp", func(tx *Tx) error {
+		var ok bool
+		chirp, ok = tx.Chirp(chirpID)
+		if !ok || chirp.Trashed() {
+			return notFoundf("No chirp found with id %v", chirpID)
+		}
+		if chirp.AuthorID != userId {
+			return newError(ErrForbidden, "Chirp Author Invalid Authorization")
+		}
+		now := time.Now().UTC()
+		if !db.editable(chirp, now) {
+			return newError(ErrForbidden, "Chirp can no longer be edited")
+		}
+		if chirp.Body == body {
+			return nil
+		}
+
+		written := chirp.CreatedAt
+		if chirp.EditedAt != nil {
+			written = chirp.EditedAt
+		}
+		revisions := tx.Revisions(chirpID)
+		history := ChirpHistory{
+			ChirpID: chirpID,
+			Revisions: append(revisions[:len(revisions):len(revisions)], ChirpRevision{
+				Revision:  len(revisions) + 1,
+				Body:      chirp.Body,
+				CreatedAt: *written,
+			}),
+		}
+		err := tx.PutRevisions(history)
+		if err != nil {
+			return err
+		}
+		chirp.Body = body
+		chirp.Edited = true
+		chirp.EditedAt = &now
+		chirp.UpdatedAt = &now
+		return tx.PutChirp(chirp)
+	})
+	if err != nil {
+		return ChirpResource{}, err
+	}
+	return chirp, nil
+}
+
+// GetChirpRevisions returns the bodies a chirp had before it was edited,
+// oldest first.
+func (db *DB) GetChirpRevisions(chirpID int) ([]ChirpRevision, error) {
+	var revisions []ChirpRevision
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		var chirp ChirpResource
+		chirp, ok = tx.Chirp(chirpID)
+		ok = ok && tx.visible(chirp)
+		revisions = tx.Revisions(chirpID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, notFoundf("No chirp with id %v found", chirpID)
+	}
+	return revisions, nil
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEditChirp(t *testing.T) {
+	leader := NewMemoryDB(Options{EditWindow: time.Minute})
+	f := NewMemoryDB(Options{})
+	f.SetFollower(true)
+	u, _ := leader.CreateUsers(ctx, "a@b.c", "x")
+	c, _ := leader.CreateChirp(ctx, "hi", u.ID)
+	if _, err := leader.EditChirp(ctx, c.ID, u.ID+1, "ho"); !errors.Is(err, ErrForbidden) {
+		t.Fatal(err)
+	}
+	if _, err := leader.EditChirp(ctx, c.ID, u.ID, "ho"); err != nil {
+		t.Fatal(err)
+	}
+	leader.EditChirp(ctx, c.ID, u.ID, "hu")
+	evs, _ := leader.Changes(0, 0)
+	if err := f.ApplyChanges(ctx, evs); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := f.GetChirpRevisions(c.ID)
+	if err != nil || len(revs) != 2 || revs[1].Body != "ho" {
+		t.Fatal(revs, err)
+	}
+	got, _ := f.GetChirp(c.ID)
+	if !got.Edited || got.Body != "hu" {
+		t.Fatal(got)
+	}
+}
+
+func TestEditWindow(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	u, _ := db.CreateUsers(ctx, "a@b.c", "x")
+	c, _ := db.CreateChirp(ctx, "hi", u.ID)
+	if _, err := db.EditChirp(ctx, c.ID, u.ID, "ho"); !errors.Is(err, ErrForbidden) {
+		t.Fatal(err)
+	}
+	if revisions, err := db.GetChirpRevisions(c.ID); err != nil || len(revisions) != 0 {
+		t.Fatal(revisions, err)
+	}
+}
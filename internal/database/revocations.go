@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Revocation marks a refresh token as revoked. It is stored under the hash of
+// the token, never the token itself, and can be dropped once the token has
+// expired on its own.
+type Revocation struct {
+	RevokedAt int64 `json:"revoked_at"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// legacyRevocationTTL is how long a token revoked before expiries were
+// tracked is kept around if its expiry can't be read from the token. It
+// matches the lifetime of refresh tokens.
+const legacyRevocationTTL = 60 * 24 * time.Hour
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeToken revokes token until expiresAt, after which it is rejected for
+// having expired anyway.
+func (db *DB) RevokeToken(ctx context.Context, token string, expiresAt time.Time) error {
+	return db.UpdateContext(ctx, "RevokeToken", func(tx *Tx) error {
+		return tx.PutRevocation(tokenHash(token), Revocation{
+			RevokedAt: time.Now().UTC().Unix(),
+			ExpiresAt: expiresAt.UTC().Unix(),
+		})
+	})
+}
+
+func (db *DB) IsTokenRevoked(token string) (bool, error) {
+	var ok bool
+	err := db.View(func(tx *Tx) error {
+		_, ok = tx.Revocation(tokenHash(token))
+		return nil
+	})
+	return ok, err
+}
+
+// hashLegacyRevokedTokens moves raw revoked tokens over to Revocations.
+func hashLegacyRevokedTokens(dbData *DBData) error {
+	for token, revokedAt := range dbData.RevokedTokens {
+		expiresAt, ok := tokenExpiry(token)
+		if !ok {
+			expiresAt = time.Unix(revokedAt, 0).Add(legacyRevocationTTL).Unix()
+		}
+		dbData.Revocations[tokenHash(token)] = Revocation{
+			RevokedAt: revokedAt,
+			ExpiresAt: expiresAt,
+		}
+	}
+	dbData.RevokedTokens = nil
+	return nil
+}
+
+// tokenExpiry reads the exp claim out of a JWT without verifying it. That is
+// fine here, the token was verified when it was revoked.
+func tokenExpiry(token string) (int64, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == 0 {
+		return 0, false
+	}
+	return claims.Exp, true
+}
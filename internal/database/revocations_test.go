@@ -0,0 +1,28 @@
+package database
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRevocationMigration(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	// Revoked tokens used to be stored raw, with when they were revoked
+	os.WriteFile(path, []byte(`{"chirps":{},"users":{},"revoked_tokens":{"a.eyJleHAiOjEwMDB9.c":5,"raw":100}}`), 0600)
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if revoked, _ := db.IsTokenRevoked("raw"); !revoked {
+		t.Fatal("raw token is no longer revoked")
+	}
+	reports, err := db.ApplyRetention(ctx, time.Unix(2000, 0), false)
+	if err != nil || reports[0].Rule != RuleRevocations || reports[0].Purged != 1 {
+		t.Fatal(reports, err)
+	}
+	if revoked, _ := db.IsTokenRevoked("a.eyJleHAiOjEwMDB9.c"); revoked {
+		t.Fatal("expired token was not purged")
+	}
+}
@@ -0,0 +1,588 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchHit is a chirp matching a search, with how relevant it is.
+type SearchHit struct {
+	ChirpResource
+	Score float64 `json:"score"`
+}
+
+// Tuning of the BM25 ranking.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// tokenize splits text into lower cased words, for both indexing and
+// searching. Anything that isn't a letter or digit separates words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexText adds the words of chirp to the full-text index, along with
+// where in the chirp they are so phrases can be matched.
+func (ix *indexes) indexText(chirp ChirpResource) {
+	words := tokenize(chirp.Body)
+	for pos, word := range words {
+		postings, ok := ix.terms[word]
+		if !ok {
+			postings = map[int][]int{}
+			ix.terms[word] = postings
+		}
+		postings[chirp.ID] = append(postings[chirp.ID], pos)
+	}
+	ix.chirpLength[chirp.ID] = len(words)
+	ix.totalLength += len(words)
+}
+
+func (ix *indexes) unindexText(chirp ChirpResource) {
+	for _, word := range tokenize(chirp.Body) {
+		postings := ix.terms[word]
+		delete(postings, chirp.ID)
+		if len(postings) == 0 {
+			delete(ix.terms, word)
+		}
+	}
+	ix.totalLength -= ix.chirpLength[chirp.ID]
+	delete(ix.chirpLength, chirp.ID)
+}
+
+// searchNode is a parsed search query, or part of one.
+type searchNode interface {
+	// match returns the IDs of the chirps matching the node.
+	match(s *searcher) map[int]struct{}
+}
+
+type termNode struct{ term string }
+
+type phraseNode struct{ terms []string }
+
+// fromNode matches chirps by the user with the given ID, public ID or
+// email.
+type fromNode struct{ user string }
+
+// timeNode matches chirps created at or after at, or before it if before is
+// set.
+type timeNode struct {
+	at     time.Time
+	before bool
+}
+
+type andNode struct{ left, right searchNode }
+
+type orNode struct{ left, right searchNode }
+
+type notNode struct{ node searchNode }
+
+// searcher evaluates a query against the data of a Tx.
+type searcher struct {
+	tx *Tx
+}
+
+func (n termNode) match(s *searcher) map[int]struct{} {
+	ids := map[int]struct{}{}
+	for id := range s.tx.ix.terms[n.term] {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (n phraseNode) match(s *searcher) map[int]struct{} {
+	ids := map[int]struct{}{}
+	first := s.tx.ix.terms[n.terms[0]]
+	for id, positions := range first {
+		for _, pos := range positions {
+			if s.phraseAt(id, pos, n.terms[1:]) {
+				ids[id] = struct{}{}
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// phraseAt reports whether terms follow on one by one after position pos of
+// the chirp.
+func (s *searcher) phraseAt(id int, pos int, terms []string) bool {
+	for offset, term := range terms {
+		found := false
+		for _, p := range s.tx.ix.terms[term][id] {
+			if p == pos+offset+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (n fromNode) match(s *searcher) map[int]struct{} {
+	ids := map[int]struct{}{}
+	user, ok := s.user(n.user)
+	if !ok {
+		return ids
+	}
+	for id := range s.tx.ix.chirpsByAuthor[user.ID] {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (s *searcher) user(ref string) (DetailedUserResource, bool) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return s.tx.User(id)
+	}
+	if strings.Contains(ref, "@") {
+		return s.tx.UserByEmail(ref)
+	}
+	for _, user := range s.tx.data.Users {
+		if user.PublicID != "" && user.PublicID == ref {
+			return user, true
+		}
+	}
+	return DetailedUserResource{}, false
+}
+
+func (n timeNode) match(s *searcher) map[int]struct{} {
+	ids := map[int]struct{}{}
+	for id, chirp := range s.tx.data.Chirps {
+		if chirp.CreatedAt == nil || chirp.CreatedAt.Before(n.at) != n.before {
+			continue
+		}
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (n andNode) match(s *searcher) map[int]struct{} {
+	left, right := n.left.match(s), n.right.match(s)
+	ids := map[int]struct{}{}
+	for id := range left {
+		if _, ok := right[id]; ok {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+func (n orNode) match(s *searcher) map[int]struct{} {
+	ids := n.left.match(s)
+	for id := range n.right.match(s) {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (n notNode) match(s *searcher) map[int]struct{} {
+	excluded := n.node.match(s)
+	ids := map[int]struct{}{}
+	for id := range s.tx.data.Chirps {
+		if _, ok := excluded[id]; !ok {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// scoredTerms lists the words of a query that count towards relevance,
+// i.e. every term and phrase word not under a NOT.
+func scoredTerms(node searchNode) []string {
+	switch n := node.(type) {
+	case termNode:
+		return []string{n.term}
+	case phraseNode:
+		return append([]string(nil), n.terms...)
+	case andNode:
+		return append(scoredTerms(n.left), scoredTerms(n.right)...)
+	case orNode:
+		return append(scoredTerms(n.left), scoredTerms(n.right)...)
+	}
+	return nil
+}
+
+// score ranks a chirp by BM25 over the given terms.
+func (s *searcher) score(id int, terms []string) float64 {
+	ix := s.tx.ix
+	count := float64(len(ix.chirpLength))
+	if count == 0 {
+		return 0
+	}
+	avgLength := float64(ix.totalLength) / count
+	if avgLength == 0 {
+		avgLength = 1
+	}
+	length := float64(ix.chirpLength[id])
+	score := 0.0
+	for _, term := range terms {
+		postings := ix.terms[term]
+		tf := float64(len(postings[id]))
+		if tf == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (count-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLength))
+	}
+	return score
+}
+
+// searchCursor is what the NextCursor of a search holds. Query ties it to
+// the search it came from.
+type searchCursor struct {
+	Query  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+// SearchChirps finds the visible chirps matching a query, most relevant
+// first and newest first among equally relevant ones. A query is made of:
+//
+//   - words, matching chirps containing them regardless of case
+//   - "quoted phrases", matching those words next to each other
+//   - from:<user>, matching chirps by a user given by ID, public ID or email
+//   - since:<date> and until:<date>, matching chirps created from or up to
+//     and including a date (2006-01-02) or time (RFC 3339)
+//   - AND, OR and NOT (or a leading -) in capitals, and parentheses
+//
+// Parts without an operator in between must all match. Up to limit hits are
+// returned, continuing after cursor if given, which is the NextCursor of an
+// earlier page of the same query.
+func (db *DB) SearchChirps(query string, limit int, cursor string) (Page[SearchHit], error) {
+	node, err := parseSearch(query)
+	if err != nil {
+		return Page[SearchHit]{}, err
+	}
+	offset := 0
+	if cursor != "" {
+		offset, err = decodeSearchCursor(query, cursor)
+		if err != nil {
+			return Page[SearchHit]{}, err
+		}
+	}
+
+	var hits []SearchHit
+	err = db.View(func(tx *Tx) error {
+		s := &searcher{tx: tx}
+		terms := scoredTerms(node)
+		for id := range node.match(s) {
+			chirp, ok := tx.Chirp(id)
+			if !ok || !tx.visible(chirp) {
+				continue
+			}
+			hits = append(hits, SearchHit{ChirpResource: chirp, Score: s.score(id, terms)})
+		}
+		return nil
+	})
+	if err != nil {
+		return Page[SearchHit]{}, err
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+
+	start := min(offset, len(hits))
+	end := len(hits)
+	if limit > 0 {
+		end = min(start+limit, end)
+	}
+	page := Page[SearchHit]{Items: hits[start:end]}
+	if end < len(hits) {
+		data, err := json.Marshal(searchCursor{Query: query, Offset: end})
+		if err != nil {
+			return Page[SearchHit]{}, err
+		}
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return page, nil
+}
+
+func decodeSearchCursor(query string, cursor string) (int, error) {
+	invalid := newError(ErrInvalid, "Invalid cursor")
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, invalid
+	}
+	c := searchCursor{}
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.Offset < 0 {
+		return 0, invalid
+	}
+	if c.Query != query {
+		return 0, newError(ErrInvalid, "Cursor belongs to a different search")
+	}
+	return c.Offset, nil
+}
+
+// Kinds of search query tokens.
+const (
+	tokWord = iota
+	tokPhrase
+	tokOpen
+	tokClose
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type searchToken struct {
+	kind int
+	text string
+}
+
+func lexSearch(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: tokOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: tokClose})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, newError(ErrInvalid, "Unterminated phrase in search query")
+			}
+			tokens = append(tokens, searchToken{kind: tokPhrase, text: string(runes[i+1 : end])})
+			i = end + 1
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, searchToken{kind: tokNot})
+			i++
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			switch word {
+			case "AND":
+				tokens = append(tokens, searchToken{kind: tokAnd})
+			case "OR":
+				tokens = append(tokens, searchToken{kind: tokOr})
+			case "NOT":
+				tokens = append(tokens, searchToken{kind: tokNot})
+			default:
+				tokens = append(tokens, searchToken{kind: tokWord, text: word})
+			}
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// searchParser parses
+//
+//	or      = and { OR and }
+//	and     = unary { [AND] unary }
+//	unary   = NOT unary | primary
+//	primary = ( or ) | phrase | word
+//
+// Words and phrases without any letters or digits in them are dropped, so
+// any part of the tree can come out nil.
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func parseSearch(query string) (searchNode, error) {
+	tokens, err := lexSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, newError(ErrInvalid, "Search query is empty")
+	}
+	p := &searchParser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, newError(ErrInvalid, "Unexpected ) in search query")
+	}
+	if node == nil {
+		return nil, newError(ErrInvalid, "Search query is empty")
+	}
+	return node, nil
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *searchParser) or() (searchNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokOr {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = combine(left, right, func(l, r searchNode) searchNode { return orNode{left: l, right: r} })
+	}
+}
+
+func (p *searchParser) and() (searchNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokOr || tok.kind == tokClose {
+			return left, nil
+		}
+		if tok.kind == tokAnd {
+			p.pos++
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = combine(left, right, func(l, r searchNode) searchNode { return andNode{left: l, right: r} })
+	}
+}
+
+// combine joins two nodes with an operator, or returns whichever of them
+// isn't nil.
+func combine(left, right searchNode, op func(l, r searchNode) searchNode) searchNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	}
+	return op(left, right)
+}
+
+func (p *searchParser) unary() (searchNode, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, newError(ErrInvalid, "Search query ends with an operator")
+	}
+	if tok.kind != tokNot {
+		return p.primary()
+	}
+	p.pos++
+	node, err := p.unary()
+	if err != nil || node == nil {
+		return nil, err
+	}
+	return notNode{node: node}, nil
+}
+
+func (p *searchParser) primary() (searchNode, error) {
+	tok, _ := p.peek()
+	p.pos++
+	switch tok.kind {
+	case tokOpen:
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		next, ok := p.peek()
+		if !ok || next.kind != tokClose {
+			return nil, newError(ErrInvalid, "Missing ) in search query")
+		}
+		p.pos++
+		return node, nil
+	case tokPhrase:
+		return wordsNode(tokenize(tok.text)), nil
+	case tokWord:
+		return wordNode(tok.text)
+	case tokClose:
+		return nil, newError(ErrInvalid, "Unexpected ) in search query")
+	}
+	return nil, newError(ErrInvalid, "Unexpected operator in search query")
+}
+
+// wordNode parses a single word of a query, which may be a field:value
+// filter. A word that tokenizes into several, like "it's", is a phrase.
+func wordNode(word string) (searchNode, error) {
+	name, value, ok := strings.Cut(word, ":")
+	if ok && value != "" {
+		switch strings.ToLower(name) {
+		case "from":
+			return fromNode{user: value}, nil
+		case "since":
+			at, err := parseSearchTime(value, false)
+			if err != nil {
+				return nil, err
+			}
+			return timeNode{at: at}, nil
+		case "until":
+			at, err := parseSearchTime(value, true)
+			if err != nil {
+				return nil, err
+			}
+			return timeNode{at: at, before: true}, nil
+		}
+	}
+	return wordsNode(tokenize(word)), nil
+}
+
+func wordsNode(words []string) searchNode {
+	switch len(words) {
+	case 0:
+		return nil
+	case 1:
+		return termNode{term: words[0]}
+	}
+	return phraseNode{terms: words}
+}
+
+// parseSearchTime reads a date or RFC 3339 time. A date given for until
+// covers the whole of that day.
+func parseSearchTime(value string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		if until {
+			// until is inclusive, timeNode matches before
+			t = t.Add(time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, newError(ErrInvalid, fmt.Sprintf("Invalid date %v in search query, use 2006-01-02 or RFC 3339", value))
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,32 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	m := NewMemoryDB(Options{})
+	u, _ := m.CreateUsers(ctx, "a@b.c", "x")
+	m.CreateChirp(ctx, "hello big world", u.ID)
+	c2, _ := m.CreateChirp(ctx, "big hello", u.ID)
+	for _, q := range []string{"", "  ", "()", "a OR", "(a", "a)", "\"x", "since:nope"} {
+		if _, err := m.SearchChirps(q, 10, ""); !errors.Is(err, ErrInvalid) {
+			t.Fatal(q, err)
+		}
+	}
+	p, _ := m.SearchChirps(`"hello big"`, 10, "")
+	if len(p.Items) != 1 || p.Items[0].ID != 1 {
+		t.Fatal(p)
+	}
+	m.DeleteChirp(ctx, c2.ID, u.ID)
+	p, _ = m.SearchChirps(`big`, 10, "")
+	if len(p.Items) != 1 {
+		t.Fatal(p)
+	}
+	m.RestoreChirp(ctx, c2.ID, u.ID)
+	p, _ = m.SearchChirps(`-world`, 10, "")
+	if len(p.Items) != 1 || p.Items[0].ID != 2 {
+		t.Fatal(p)
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotFile is the on-disk shape of db.json. Checksum is the hex encoded
+// SHA-256 of Data, or of Ciphertext when the file is encrypted, so a
+// truncated or otherwise damaged file can be told apart from a good one.
+type snapshotFile struct {
+	Checksum   string          `json:"checksum"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Ciphertext []byte          `json:"ciphertext,omitempty"`
+}
+
+// CorruptError is returned when a snapshot can't be read back. Backup is the
+// newest backup that could be used to recover, if there is one.
+type CorruptError struct {
+	Path   string
+	Backup string
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	msg := fmt.Sprintf("%v is corrupt: %v", e.Path, e.Err)
+	if e.Backup == "" {
+		return msg + ", and no valid backup was found"
+	}
+	return msg + fmt.Sprintf(", newest valid backup is %v (start with --recover to restore it)", e.Backup)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeSnapshot serialises dbData, encrypting it if s is not nil.
+func encodeSnapshot(dbData DBData, s *sealer) ([]byte, error) {
+	data, err := json.Marshal(dbData)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return json.Marshal(snapshotFile{
+			Checksum: checksum(data),
+			Data:     data,
+		})
+	}
+	sealed, err := s.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshotFile{
+		Checksum:   checksum(sealed),
+		Ciphertext: sealed,
+	})
+}
+
+// decodeSnapshot verifies and parses a snapshot, and reports whether it was
+// encrypted. Files written before checksums were added are plain DBData and
+// are accepted as they are.
+func decodeSnapshot(raw []byte, s *sealer) (DBData, bool, error) {
+	dbData := DBData{}
+	file := snapshotFile{}
+	err := json.Unmarshal(raw, &file)
+	if err != nil {
+		return dbData, false, err
+	}
+	encrypted := file.Ciphertext != nil
+	data := []byte(file.Data)
+	if encrypted {
+		data = file.Ciphertext
+	}
+	if file.Checksum == "" {
+		data = raw
+	} else if checksum(data) != file.Checksum {
+		return dbData, encrypted, errors.New("checksum mismatch")
+	}
+	if encrypted {
+		data, err = s.open(data)
+		if err != nil {
+			return dbData, encrypted, err
+		}
+	}
+	err = json.Unmarshal(data, &dbData)
+	if err != nil {
+		return dbData, encrypted, err
+	}
+	fillEmptyMaps(&dbData)
+	return dbData, encrypted, nil
+}
+
+// readSnapshot loads the snapshot at path, reporting anything that can't be
+// decoded as a *CorruptError. Missing or wrong keys are not corruption and
+// are returned as they are.
+func readSnapshot(path string, s *sealer) (DBData, bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return DBData{}, false, err
+	}
+	dbData, encrypted, err := decodeSnapshot(raw, s)
+	if errors.Is(err, ErrNoKey) || errors.Is(err, ErrWrongKey) {
+		return dbData, encrypted, fmt.Errorf("%v: %w", path, err)
+	}
+	if err != nil {
+		return dbData, encrypted, &CorruptError{Path: path, Err: err}
+	}
+	return dbData, encrypted, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it over path, so path always holds either the old or the new
+// contents in full.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0600)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func backupPath(path string, at time.Time) string {
+	return fmt.Sprintf("%v.bak.%d", path, at.UnixNano())
+}
+
+// listBackups returns the backups of the snapshot at path, newest first.
+func listBackups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".bak.*")
+	if err != nil {
+		return nil, err
+	}
+	stamps := map[string]int64{}
+	var backups []string
+	for _, match := range matches {
+		stamp, err := strconv.ParseInt(strings.TrimPrefix(match, path+".bak."), 10, 64)
+		if err != nil {
+			continue
+		}
+		stamps[match] = stamp
+		backups = append(backups, match)
+	}
+	sort.Slice(backups, func(p, q int) bool {
+		return stamps[backups[p]] > stamps[backups[q]]
+	})
+	return backups, nil
+}
+
+// writeBackup stores data as the newest backup of path and removes all but
+// the newest keep backups.
+func writeBackup(path string, data []byte, keep int) error {
+	err := writeFileAtomic(backupPath(path, time.Now().UTC()), data)
+	if err != nil {
+		return err
+	}
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	for idx, backup := range backups {
+		if idx < keep {
+			continue
+		}
+		err = os.Remove(backup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestValidBackup returns the newest backup of path that passes its
+// checksum, or an empty string if there is none.
+func newestValidBackup(path string, s *sealer) (string, error) {
+	backups, err := listBackups(path)
+	if err != nil {
+		return "", err
+	}
+	for _, backup := range backups {
+		_, _, err := readSnapshot(backup, s)
+		if err == nil {
+			return backup, nil
+		}
+	}
+	return "", nil
+}
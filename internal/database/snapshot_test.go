@@ -0,0 +1,62 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecoverFromBackup(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	opts := Options{Backups: 2}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "x")
+	db.CreateChirp(ctx, "one", 1)
+	db.Close()
+	db, _ = NewDB(path, opts)
+	db.CreateChirp(ctx, "two", 1)
+	db.Close()
+
+	os.WriteFile(path, []byte(`{"checksum":"abc","data":{"chi`), 0600)
+	_, err = NewDB(path, opts)
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Backup == "" {
+		t.Fatal(err)
+	}
+
+	opts.RecoverFromBackup = true
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if chirps, _ := db.GetChirps(); len(chirps) != 2 {
+		t.Fatal(chirps)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "x")
+	db.Close()
+	// Opening again folds the log into db.json
+	db, _ = NewDB(path, Options{})
+	db.Close()
+
+	// Still valid JSON, but not what was written
+	raw, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(raw, []byte("a@b.c"), []byte("z@b.c"), 1), 0600)
+	_, err = NewDB(path, Options{})
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Backup != "" {
+		t.Fatal(err)
+	}
+}
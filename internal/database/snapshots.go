@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrSnapshotsUnsupported = newError(ErrConflict, "Snapshots are only available for databases kept on disk")
+
+// SnapshotInfo describes a snapshot taken with CreateSnapshot.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// snapshotTimeFormat names snapshots after the time they were taken, so they
+// sort by age and are safe to use in URLs.
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+func (b *jsonFileBackend) snapshotDir() string {
+	return b.path + ".snapshots"
+}
+
+func (db *DB) fileStore() (*jsonFileBackend, error) {
+	store, ok := db.store.(*jsonFileBackend)
+	if !ok {
+		return nil, ErrSnapshotsUnsupported
+	}
+	return store, nil
+}
+
+// CreateSnapshot writes a consistent copy of the database, as it is right
+// now, to the snapshot directory next to the database file. Snapshots use the
+// same format as the database file, checksum and encryption included.
+func (db *DB) CreateSnapshot() (SnapshotInfo, error) {
+	store, err := db.fileStore()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	db.mux.RLock()
+	createdAt := time.Now().UTC()
+	data, err := encodeSnapshot(db.data, store.sealer)
+	db.mux.RUnlock()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	err = os.MkdirAll(store.snapshotDir(), 0700)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	name := createdAt.Format(snapshotTimeFormat)
+	err = writeFileAtomic(filepath.Join(store.snapshotDir(), name+".json"), data)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{
+		Name:      name,
+		CreatedAt: createdAt,
+		Size:      int64(len(data)),
+	}, nil
+}
+
+// ListSnapshots returns every snapshot, newest first.
+func (db *DB) ListSnapshots() ([]SnapshotInfo, error) {
+	store, err := db.fileStore()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(store.snapshotDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []SnapshotInfo
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		createdAt, err := time.Parse(snapshotTimeFormat, name)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:      name,
+			CreatedAt: createdAt,
+			Size:      info.Size(),
+		})
+	}
+	sort.Slice(snapshots, func(p, q int) bool {
+		return snapshots[p].CreatedAt.After(snapshots[q].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// PruneSnapshots removes all but the newest keep snapshots, and returns the
+// ones it removed.
+func (db *DB) PruneSnapshots(keep int) ([]SnapshotInfo, error) {
+	store, err := db.fileStore()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := db.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var removed []SnapshotInfo
+	for idx, snapshot := range snapshots {
+		if idx < keep {
+			continue
+		}
+		err = os.Remove(filepath.Join(store.snapshotDir(), snapshot.Name+".json"))
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, snapshot)
+	}
+	return removed, nil
+}
+
+// RestoreSnapshot replaces the whole database with the named snapshot. The
+// snapshot is fully read, verified and migrated before anything is touched,
+// and the current data is snapshotted first so a restore can be undone.
+func (db *DB) RestoreSnapshot(ctx context.Context, name string) (SnapshotInfo, error) {
+	store, err := db.fileStore()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	_, err = time.Parse(snapshotTimeFormat, name)
+	if err != nil {
+		return SnapshotInfo{}, notFoundf("No snapshot named %v found", name)
+	}
+	raw, err := os.ReadFile(filepath.Join(store.snapshotDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return SnapshotInfo{}, notFoundf("No snapshot named %v found", name)
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	db.mux.RLock()
+	dbData, _, err := decodeSnapshot(raw, store.sealer)
+	db.mux.RUnlock()
+	if err != nil {
+		return SnapshotInfo{}, newError(ErrInvalid, "Snapshot "+name+" is not valid: "+err.Error())
+	}
+	_, err = runMigrations(&dbData)
+	if err != nil {
+		return SnapshotInfo{}, newError(ErrInvalid, "Snapshot "+name+" can't be migrated: "+err.Error())
+	}
+
+	undo, err := db.CreateSnapshot()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.closed {
+		return SnapshotInfo{}, ErrClosed
+	}
+	err = db.writableBy(ctx)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	// IDs handed out since the snapshot was taken must stay retired. The
+	// restore itself uses up a change sequence number, so consumers of the
+	// change events find out that they have to resync.
+	for entity, last := range db.data.Sequences {
+		if last > dbData.Sequences[entity] {
+			dbData.Sequences[entity] = last
+		}
+	}
+	dbData.Sequences[entityChange]++
+	err = db.replaceData(ctx, "RestoreSnapshot", name, dbData)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return undo, nil
+}
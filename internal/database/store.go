@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Store is the storage surface the API handlers depend on. DB implements it
+// on top of either a JSON file or a purely in-memory backend.
+type Store interface {
+	Update(fn func(tx *Tx) error) error
+	UpdateContext(ctx context.Context, action string, fn func(tx *Tx) error) error
+	View(fn func(tx *Tx) error) error
+
+	CreateChirp(ctx context.Context, body string, authorId int) (ChirpResource, error)
+	DeleteChirp(ctx context.Context, chirpID int, userId int) error
+	GetChirp(id int) (ChirpResource, error)
+	GetChirpByPublicID(publicID string) (ChirpResource, error)
+	GetChirps() ([]ChirpResource, error)
+	GetChirpsByAuthor(authorID int) ([]ChirpResource, error)
+	QueryChirps(q Query) (Page[ChirpResource], error)
+	SearchChirps(query string, limit int, cursor string) (Page[SearchHit], error)
+	GetTrash(authorID int) ([]ChirpResource, error)
+	RestoreChirp(ctx context.Context, chirpID int, userId int) (ChirpResource, error)
+	EditChirp(ctx context.Context, chirpID int, userId int, body string) (ChirpResource, error)
+	GetChirpRevisions(chirpID int) ([]ChirpRevision, error)
+
+	CreateUsers(ctx context.Context, email string, hash string) (UserResource, error)
+	UpdateUsers(ctx context.Context, user DetailedUserResource) error
+	DeleteUser(ctx context.Context, userID int) error
+	MarkUserChirpyRed(ctx context.Context, userID int) error
+	GetUser(id int) (UserResource, error)
+	GetUsers() ([]UserResource, error)
+	QueryUsers(q Query) (Page[UserResource], error)
+	GetUserByEmail(email string) (DetailedUserResource, error)
+
+	RevokeToken(ctx context.Context, token string, expiresAt time.Time) error
+	IsTokenRevoked(token string) (bool, error)
+
+	ApplyRetention(ctx context.Context, now time.Time, dryRun bool) ([]RetentionReport, error)
+	RetentionStats() []RetentionStats
+	PlaceHold(ctx context.Context, entity string, id int, reason string) (LegalHold, error)
+	ReleaseHold(ctx context.Context, entity string, id int) error
+	GetHolds() ([]LegalHold, error)
+
+	Subscribe(after int) (*Subscription, error)
+	Changes(after int, limit int) ([]Event, error)
+	LastChangeSeq() int
+
+	ReplicationSnapshot() ([]byte, int, error)
+	LoadReplicationSnapshot(ctx context.Context, raw []byte) error
+	ApplyChanges(ctx context.Context, events []Event) error
+	SetFollower(follower bool)
+	Follower() bool
+
+	AuditLog(q AuditQuery) ([]AuditEntry, error)
+	VerifyAudit() (int, error)
+
+	ExportUsers(w io.Writer, opts TransferOptions) (int, error)
+	ExportChirps(w io.Writer, opts TransferOptions) (int, error)
+	Import(ctx context.Context, users io.Reader, chirps io.Reader, opts TransferOptions) (ImportResult, error)
+
+	CreateSnapshot() (SnapshotInfo, error)
+	ListSnapshots() ([]SnapshotInfo, error)
+	PruneSnapshots(keep int) ([]SnapshotInfo, error)
+	RestoreSnapshot(ctx context.Context, name string) (SnapshotInfo, error)
+
+	FlushError() error
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+var ctx = context.Background()
+
+func TestStoreBackends(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	fileDB, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileDB.Close()
+	memoryDB := NewMemoryDB(Options{})
+	defer memoryDB.Close()
+
+	for name, store := range map[string]Store{"memory": memoryDB, "file": fileDB} {
+		u, err := store.CreateUsers(ctx, "a@b.c", "h")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		c, err := store.CreateChirp(ctx, "hello", u.ID)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		store.CreateChirp(ctx, "world", u.ID)
+		if got, err := store.GetChirp(c.ID); err != nil || got.Body != "hello" || got.AuthorID != u.ID {
+			t.Fatal(name, got, err)
+		}
+		if err := store.DeleteChirp(ctx, c.ID, u.ID); err != nil {
+			t.Fatal(name, err)
+		}
+		if chirps, _ := store.GetChirps(); len(chirps) != 1 || chirps[0].Body != "world" {
+			t.Fatal(name, chirps)
+		}
+		if got, err := store.GetUserByEmail("a@b.c"); err != nil || got.ID != u.ID {
+			t.Fatal(name, got, err)
+		}
+	}
+
+	// Only the file backend keeps anything once closed
+	fileDB.Close()
+	fileDB, err = NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileDB.Close()
+	if chirps, _ := fileDB.GetChirps(); len(chirps) != 1 {
+		t.Fatal(chirps)
+	}
+}
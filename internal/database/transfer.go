@@ -0,0 +1,649 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Format is a file format users and chirps can be imported from and
+// exported to.
+type Format string
+
+const (
+	// NDJSON is one JSON object per line, with the same fields the API uses.
+	NDJSON Format = "ndjson"
+	// CSV is comma separated values with a header row naming the fields.
+	CSV Format = "csv"
+)
+
+// FormatFromPath picks the format from a file extension.
+func FormatFromPath(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return NDJSON, nil
+	case ".csv":
+		return CSV, nil
+	}
+	return "", newError(ErrInvalid, fmt.Sprintf("Can't tell the format of %v, use .ndjson, .jsonl or .csv", path))
+}
+
+// Progress is reported while a file is imported or exported. Bytes is how
+// much of the input has been read so far, and is always zero on export.
+type Progress struct {
+	Entity string
+	Rows   int
+	Bytes  int64
+}
+
+// TransferOptions tune imports and exports.
+type TransferOptions struct {
+	Format Format
+	// IncludePasswords exports password hashes along with users. They are
+	// left out otherwise.
+	IncludePasswords bool
+	// Progress is called every progressEvery rows, and once more when done.
+	Progress func(Progress)
+}
+
+const progressEvery = 1000
+
+// ImportResult counts the rows imported, and maps the IDs found in the
+// imported files to the IDs the rows were stored under.
+type ImportResult struct {
+	Users    int
+	Chirps   int
+	UserIDs  map[int]int
+	ChirpIDs map[int]int
+}
+
+// ImportError points at the row of an import that could not be stored.
+type ImportError struct {
+	Entity string
+	Line   int
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("Error importing %vs on line %v: %v", e.Entity, e.Line, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// transferUser is a user as it is imported and exported. Password holds a
+// bcrypt hash, not a plaintext password.
+type transferUser struct {
+	ID          int        `json:"id"`
+	Email       string     `json:"email"`
+	PublicID    string     `json:"public_id,omitempty"`
+	IsChirpyRed bool       `json:"is_chirpy_red"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	Password    string     `json:"password,omitempty"`
+}
+
+var userColumns = []string{"id", "email", "public_id", "is_chirpy_red", "created_at", "updated_at"}
+var chirpColumns = []string{"id", "author_id", "public_id", "body", "created_at", "updated_at"}
+
+// ExportUsers writes every user that hasn't deleted their account to w,
+// ordered by ID, and returns how many were written.
+func (db *DB) ExportUsers(w io.Writer, opts TransferOptions) (int, error) {
+	columns := slices.Clone(userColumns)
+	if opts.IncludePasswords {
+		columns = append(columns, "password")
+	}
+	var users []DetailedUserResource
+	err := db.View(func(tx *Tx) error {
+		for _, user := range tx.Users() {
+			if !user.Deleted() {
+				users = append(users, user)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	rw, err := newRowWriter(w, opts.Format, columns)
+	if err != nil {
+		return 0, err
+	}
+	for idx, user := range users {
+		row := transferUser{
+			ID:          user.ID,
+			Email:       user.Email,
+			PublicID:    user.PublicID,
+			IsChirpyRed: user.IsChirpyRed,
+			CreatedAt:   user.CreatedAt,
+			UpdatedAt:   user.UpdatedAt,
+		}
+		if opts.IncludePasswords {
+			row.Password = user.Password
+		}
+		err = rw.write(row, []string{
+			strconv.Itoa(row.ID),
+			row.Email,
+			row.PublicID,
+			strconv.FormatBool(row.IsChirpyRed),
+			formatTime(row.CreatedAt),
+			formatTime(row.UpdatedAt),
+			row.Password,
+		}[:len(columns)])
+		if err != nil {
+			return idx, err
+		}
+		reportProgress(opts, entityUser, idx+1, 0, false)
+	}
+	reportProgress(opts, entityUser, len(users), 0, true)
+	return len(users), rw.flush()
+}
+
+// ExportChirps writes every chirp that isn't in the trash or written by a
+// deleted user to w, ordered by ID, and returns how many were written.
+func (db *DB) ExportChirps(w io.Writer, opts TransferOptions) (int, error) {
+	var chirps []ChirpResource
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.visibleChirps(tx.Chirps())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+
+	rw, err := newRowWriter(w, opts.Format, chirpColumns)
+	if err != nil {
+		return 0, err
+	}
+	for idx, chirp := range chirps {
+		err = rw.write(chirp, []string{
+			strconv.Itoa(chirp.ID),
+			strconv.Itoa(chirp.AuthorID),
+			chirp.PublicID,
+			chirp.Body,
+			formatTime(chirp.CreatedAt),
+			formatTime(chirp.UpdatedAt),
+		})
+		if err != nil {
+			return idx, err
+		}
+		reportProgress(opts, entityChirp, idx+1, 0, false)
+	}
+	reportProgress(opts, entityChirp, len(chirps), 0, true)
+	return len(chirps), rw.flush()
+}
+
+// Import adds the users and then the chirps read from the given readers,
+// either of which can be nil. Every row is stored under a freshly allocated
+// ID (and public ID), and chirps are pointed at the new ID of their author.
+// When users are imported, every chirp's author_id must be one of them,
+// otherwise it must be a user that already exists. Rows are checked like
+// the API checks them: emails are normalized, passwords must be bcrypt
+// hashes and chirp bodies are cleaned. Either everything is imported or, on
+// the first bad row, nothing is.
+//
+// The files are read and checked before the database is locked, so only
+// storing the rows holds up other requests.
+func (db *DB) Import(ctx context.Context, users io.Reader, chirps io.Reader, opts TransferOptions) (ImportResult, error) {
+	var userRows []importRow[transferUser]
+	var chirpRows []importRow[ChirpResource]
+	var err error
+	if users != nil {
+		userRows, err = readImportUsers(users, opts)
+		if err != nil {
+			return ImportResult{}, err
+		}
+	}
+	if chirps != nil {
+		var authors map[int]bool
+		if users != nil {
+			authors = map[int]bool{}
+			for _, user := range userRows {
+				if user.row.ID != 0 {
+					authors[user.row.ID] = true
+				}
+			}
+		}
+		chirpRows, err = readImportChirps(chirps, opts, authors)
+		if err != nil {
+			return ImportResult{}, err
+		}
+	}
+
+	result := ImportResult{
+		Users:    len(userRows),
+		Chirps:   len(chirpRows),
+		UserIDs:  map[int]int{},
+		ChirpIDs: map[int]int{},
+	}
+	err = db.UpdateContext(ctx, "Import", func(tx *Tx) error {
+		for _, user := range userRows {
+			err := db.importUser(tx, user.row, result.UserIDs)
+			if err != nil {
+				return &ImportError{Entity: entityUser, Line: user.line, Err: err}
+			}
+		}
+		authors := result.UserIDs
+		if users == nil {
+			authors = nil
+		}
+		for _, chirp := range chirpRows {
+			err := db.importChirp(tx, chirp.row, authors, result.ChirpIDs)
+			if err != nil {
+				return &ImportError{Entity: entityChirp, Line: chirp.line, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
+
+// importRow is a row read from an import, along with the line it was on.
+type importRow[T any] struct {
+	row  T
+	line int
+}
+
+func readImportUsers(r io.Reader, opts TransferOptions) ([]importRow[transferUser], error) {
+	rr, err := newRowReader(r, opts.Format, []string{"email"})
+	if err != nil {
+		return nil, &ImportError{Entity: entityUser, Line: 1, Err: err}
+	}
+	var rows []importRow[transferUser]
+	seen := map[int]bool{}
+	for {
+		var row transferUser
+		err := rr.next(&row, func(fields map[string]string) error {
+			return userFromFields(&row, fields)
+		})
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = checkImportUser(&row, seen)
+		}
+		if err != nil {
+			return nil, &ImportError{Entity: entityUser, Line: rr.line, Err: err}
+		}
+		rows = append(rows, importRow[transferUser]{row: row, line: rr.line})
+		reportProgress(opts, entityUser, rr.rows, rr.bytes(), false)
+	}
+	reportProgress(opts, entityUser, rr.rows, rr.bytes(), true)
+	return rows, nil
+}
+
+// checkImportUser checks a user row on its own, and normalizes its email.
+// seen holds the IDs of the rows checked before it.
+func checkImportUser(row *transferUser, seen map[int]bool) error {
+	if row.ID != 0 {
+		if seen[row.ID] {
+			return newError(ErrConflict, fmt.Sprintf("Duplicate user id %v", row.ID))
+		}
+		seen[row.ID] = true
+	}
+	email, err := NormalizeEmail(row.Email)
+	if err != nil {
+		return err
+	}
+	row.Email = email
+	// Passwords are only ever stored hashed, anything else could never be
+	// logged in with
+	if row.Password != "" {
+		_, err = bcrypt.Cost([]byte(row.Password))
+		if err != nil {
+			return newError(ErrInvalid, "password must be a bcrypt hash")
+		}
+	}
+	return nil
+}
+
+func (db *DB) importUser(tx *Tx, row transferUser, ids map[int]int) error {
+	newID, err := tx.NextUserID()
+	if err != nil {
+		return err
+	}
+	publicID, err := db.newPublicID()
+	if err != nil {
+		return err
+	}
+	createdAt, updatedAt := importedTimes(row.CreatedAt, row.UpdatedAt)
+	err = tx.PutUser(DetailedUserResource{
+		Email:       row.Email,
+		ID:          newID,
+		PublicID:    publicID,
+		Password:    row.Password,
+		IsChirpyRed: row.IsChirpyRed,
+		CreatedAt:   createdAt,
+		UpdatedAt:   updatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if row.ID != 0 {
+		ids[row.ID] = newID
+	}
+	return nil
+}
+
+// readImportChirps checks each author_id against the IDs of the imported
+// users, unless authors is nil. Whether it matches an existing user is only
+// known once the database is locked.
+func readImportChirps(r io.Reader, opts TransferOptions, authors map[int]bool) ([]importRow[ChirpResource], error) {
+	rr, err := newRowReader(r, opts.Format, []string{"author_id", "body"})
+	if err != nil {
+		return nil, &ImportError{Entity: entityChirp, Line: 1, Err: err}
+	}
+	var rows []importRow[ChirpResource]
+	seen := map[int]bool{}
+	for {
+		var row ChirpResource
+		err := rr.next(&row, func(fields map[string]string) error {
+			return chirpFromFields(&row, fields)
+		})
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = checkImportChirp(&row, seen, authors)
+		}
+		if err != nil {
+			return nil, &ImportError{Entity: entityChirp, Line: rr.line, Err: err}
+		}
+		rows = append(rows, importRow[ChirpResource]{row: row, line: rr.line})
+		reportProgress(opts, entityChirp, rr.rows, rr.bytes(), false)
+	}
+	reportProgress(opts, entityChirp, rr.rows, rr.bytes(), true)
+	return rows, nil
+}
+
+// checkImportChirp checks a chirp row on its own, and cleans its body the
+// way a posted chirp's is.
+func checkImportChirp(row *ChirpResource, seen map[int]bool, authors map[int]bool) error {
+	if row.ID != 0 {
+		if seen[row.ID] {
+			return newError(ErrConflict, fmt.Sprintf("Duplicate chirp id %v", row.ID))
+		}
+		seen[row.ID] = true
+	}
+	if authors != nil && !authors[row.AuthorID] {
+		return newError(ErrInvalid, fmt.Sprintf("author_id %v matches no imported user", row.AuthorID))
+	}
+	body, err := CleanChirpBody(row.Body)
+	if err != nil {
+		return err
+	}
+	row.Body = body
+	return nil
+}
+
+// importChirp remaps the author_id through authors, or checks it against
+// the existing users if authors is nil.
+func (db *DB) importChirp(tx *Tx, row ChirpResource, authors map[int]int, ids map[int]int) error {
+	authorID, ok := authors[row.AuthorID]
+	if authors == nil {
+		authorID = row.AuthorID
+		author, exists := tx.User(authorID)
+		ok = exists && !author.Deleted()
+	}
+	if !ok {
+		return newError(ErrInvalid, fmt.Sprintf("author_id %v matches no imported or existing user", row.AuthorID))
+	}
+	newID, err := tx.NextChirpID()
+	if err != nil {
+		return err
+	}
+	publicID, err := db.newPublicID()
+	if err != nil {
+		return err
+	}
+	createdAt, updatedAt := importedTimes(row.CreatedAt, row.UpdatedAt)
+	err = tx.PutChirp(ChirpResource{
+		Body:      row.Body,
+		ID:        newID,
+		PublicID:  publicID,
+		AuthorID:  authorID,
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if row.ID != 0 {
+		ids[row.ID] = newID
+	}
+	return nil
+}
+
+func userFromFields(row *transferUser, fields map[string]string) error {
+	var err error
+	row.Email = fields["email"]
+	row.Password = fields["password"]
+	if fields["id"] != "" {
+		row.ID, err = strconv.Atoi(fields["id"])
+		if err != nil {
+			return newError(ErrInvalid, fmt.Sprintf("Invalid id %v", fields["id"]))
+		}
+	}
+	if fields["is_chirpy_red"] != "" {
+		row.IsChirpyRed, err = strconv.ParseBool(fields["is_chirpy_red"])
+		if err != nil {
+			return newError(ErrInvalid, fmt.Sprintf("Invalid is_chirpy_red %v", fields["is_chirpy_red"]))
+		}
+	}
+	return timesFromFields(&row.CreatedAt, &row.UpdatedAt, fields)
+}
+
+func chirpFromFields(row *ChirpResource, fields map[string]string) error {
+	var err error
+	row.Body = fields["body"]
+	if fields["id"] != "" {
+		row.ID, err = strconv.Atoi(fields["id"])
+		if err != nil {
+			return newError(ErrInvalid, fmt.Sprintf("Invalid id %v", fields["id"]))
+		}
+	}
+	row.AuthorID, err = strconv.Atoi(fields["author_id"])
+	if err != nil {
+		return newError(ErrInvalid, fmt.Sprintf("Invalid author_id %v", fields["author_id"]))
+	}
+	return timesFromFields(&row.CreatedAt, &row.UpdatedAt, fields)
+}
+
+// timesFromFields reads the optional created_at and updated_at columns.
+func timesFromFields(createdAt **time.Time, updatedAt **time.Time, fields map[string]string) error {
+	for name, dest := range map[string]**time.Time{"created_at": createdAt, "updated_at": updatedAt} {
+		if fields[name] == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields[name])
+		if err != nil {
+			return newError(ErrInvalid, fmt.Sprintf("Invalid %v %v", name, fields[name]))
+		}
+		t = t.UTC()
+		*dest = &t
+	}
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// importedTimes keeps the times a row was exported with. A row without them
+// counts as created now, and one without updated_at as never updated.
+func importedTimes(createdAt *time.Time, updatedAt *time.Time) (*time.Time, *time.Time) {
+	if createdAt == nil {
+		now := time.Now().UTC()
+		createdAt = &now
+	}
+	if updatedAt == nil {
+		updatedAt = createdAt
+	}
+	return createdAt, updatedAt
+}
+
+func reportProgress(opts TransferOptions, entity string, rows int, bytes int64, done bool) {
+	if opts.Progress == nil || (!done && rows%progressEvery != 0) {
+		return
+	}
+	opts.Progress(Progress{Entity: entity, Rows: rows, Bytes: bytes})
+}
+
+// rowReader reads rows one at a time from either format, keeping track of
+// the line it is on for error messages.
+type rowReader struct {
+	format  Format
+	counter *countingReader
+	lines   *bufio.Scanner
+	csv     *csv.Reader
+	header  []string
+	line    int
+	rows    int
+}
+
+// newRowReader checks that a CSV header names every one of the required
+// columns. NDJSON rows are checked as they are read.
+func newRowReader(r io.Reader, format Format, required []string) (*rowReader, error) {
+	rr := &rowReader{format: format, counter: &countingReader{r: r}}
+	switch format {
+	case NDJSON:
+		rr.lines = bufio.NewScanner(rr.counter)
+		rr.lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		return rr, nil
+	case CSV:
+		rr.csv = csv.NewReader(rr.counter)
+		rr.csv.ReuseRecord = true
+		header, err := rr.csv.Read()
+		if err == io.EOF {
+			return rr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rr.line = 1
+		rr.csv.FieldsPerRecord = len(header)
+		for _, name := range header {
+			rr.header = append(rr.header, strings.ToLower(strings.TrimSpace(name)))
+		}
+		for _, name := range required {
+			if !slices.Contains(rr.header, name) {
+				return nil, newError(ErrInvalid, fmt.Sprintf("Missing column %v", name))
+			}
+		}
+		return rr, nil
+	}
+	return nil, newError(ErrInvalid, fmt.Sprintf("Unknown format %v", format))
+}
+
+// next reads the next row into v for NDJSON, or hands its fields keyed by
+// column to fromFields for CSV. It returns io.EOF once there are no more rows.
+func (rr *rowReader) next(v any, fromFields func(map[string]string) error) error {
+	if rr.format == CSV {
+		if rr.header == nil {
+			return io.EOF
+		}
+		record, err := rr.csv.Read()
+		if err != nil {
+			return err
+		}
+		rr.line, _ = rr.csv.FieldPos(0)
+		rr.rows++
+		fields := map[string]string{}
+		for idx, value := range record {
+			fields[rr.header[idx]] = value
+		}
+		return fromFields(fields)
+	}
+
+	for rr.lines.Scan() {
+		rr.line++
+		line := rr.lines.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		rr.rows++
+		err := json.Unmarshal(line, v)
+		if err != nil {
+			return newError(ErrInvalid, fmt.Sprintf("Invalid JSON %v", err))
+		}
+		return nil
+	}
+	if err := rr.lines.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (rr *rowReader) bytes() int64 {
+	return rr.counter.n
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rowWriter writes rows in either format. CSV gets a header row first.
+type rowWriter struct {
+	buf  *bufio.Writer
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+func newRowWriter(w io.Writer, format Format, columns []string) (*rowWriter, error) {
+	rw := &rowWriter{buf: bufio.NewWriter(w)}
+	switch format {
+	case NDJSON:
+		rw.json = json.NewEncoder(rw.buf)
+		rw.json.SetEscapeHTML(false)
+		return rw, nil
+	case CSV:
+		rw.csv = csv.NewWriter(rw.buf)
+		return rw, rw.csv.Write(columns)
+	}
+	return nil, newError(ErrInvalid, fmt.Sprintf("Unknown format %v", format))
+}
+
+func (rw *rowWriter) write(v any, fields []string) error {
+	if rw.csv != nil {
+		return rw.csv.Write(fields)
+	}
+	return rw.json.Encode(v)
+}
+
+func (rw *rowWriter) flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.buf.Flush()
+}
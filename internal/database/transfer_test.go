@@ -0,0 +1,91 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImportValidatesRows(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	users := "id,email,password\n1,a@b.c," + string(hash) + "\n2,d@b.c,\n"
+	chirps := "id,author_id,body\n1,1,what a kerfuffle\n"
+
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	result, err := db.Import(ctx, strings.NewReader(users), strings.NewReader(chirps), TransferOptions{Format: CSV})
+	if err != nil || result.Users != 2 || result.Chirps != 1 {
+		t.Fatal(result, err)
+	}
+	chirp, _ := db.GetChirp(result.ChirpIDs[1])
+	if chirp.Body != "what a ****" {
+		t.Fatal(chirp.Body)
+	}
+
+	bad := []struct {
+		users  string
+		chirps string
+		entity string
+		line   int
+	}{
+		{"id,email,password\n1,e@b.c,secret\n", "", entityUser, 2},
+		{"", "author_id,body\n1,ok\n1," + strings.Repeat("x", MaxChirpLength+1) + "\n", entityChirp, 3},
+	}
+	for _, b := range bad {
+		var users, chirps io.Reader
+		if b.users != "" {
+			users = strings.NewReader(b.users)
+		}
+		if b.chirps != "" {
+			chirps = strings.NewReader(b.chirps)
+		}
+		_, err := db.Import(ctx, users, chirps, TransferOptions{Format: CSV})
+		var importErr *ImportError
+		if !errors.As(err, &importErr) || !errors.Is(err, ErrInvalid) || importErr.Entity != b.entity || importErr.Line != b.line {
+			t.Fatal(err)
+		}
+	}
+	if users, _ := db.GetUsers(); len(users) != 2 {
+		t.Fatal(users)
+	}
+}
+
+func TestImportDoesNotBlockWrites(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	r, w := io.Pipe()
+	defer w.Close()
+	done := make(chan error)
+	go func() {
+		_, err := db.Import(ctx, r, nil, TransferOptions{Format: CSV})
+		done <- err
+	}()
+
+	// The import is still waiting for the rest of its file
+	io.WriteString(w, "email\na@b.c\n")
+	created := make(chan error)
+	go func() {
+		_, err := db.CreateUsers(ctx, "d@b.c", "h")
+		created <- err
+	}()
+	select {
+	case err := <-created:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write was blocked by a running import")
+	}
+
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := db.GetUsers(); len(users) != 2 {
+		t.Fatal(users)
+	}
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Trashed reports whether the chirp has been deleted, and is only kept
+// around so its author can restore it.
+func (chirp ChirpResource) Trashed() bool {
+	return chirp.DeletedAt != nil
+}
+
+// restorable reports whether a trashed chirp is still within the retention
+// window of the trash rule at now. Without a trash rule chirps stay in the
+// trash forever.
+func (db *DB) restorable(chirp ChirpResource, now time.Time) bool {
+	if !chirp.Trashed() {
+		return false
+	}
+	for _, rule := range db.retentionRules() {
+		if rule.Name == RuleTrash {
+			return now.Before(chirp.DeletedAt.Add(rule.MaxAge))
+		}
+	}
+	return true
+}
+
+// GetTrash returns the chirps the given user deleted that can still be
+// restored.
+func (db *DB) GetTrash(authorID int) ([]ChirpResource, error) {
+	now := time.Now()
+	var chirps []ChirpResource
+	err := db.View(func(tx *Tx) error {
+		for _, chirp := range tx.ChirpsByAuthor(authorID) {
+			if db.restorable(chirp, now) {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+	return chirps, err
+}
+
+// RestoreChirp takes a chirp back out of the trash. Only its author can,
+// and only until the retention window has passed.
+func (db *DB) RestoreChirp(ctx context.Context, chirpID int, userId int) (ChirpResource, error) {
+	var chirp ChirpResource
+	err := db.UpdateContext(ctx, "RestoreChirp", func(tx *Tx) error {
+		var ok bool
+		chirp, ok = tx.Chirp(chirpID)
+		if !ok || !db.restorable(chirp, time.Now()) {
+			return notFoundf("No deleted chirp found with id %v", chirpID)
+		}
+		if chirp.AuthorID != userId {
+			return newError(ErrForbidden, "Chirp Author Invalid Authorization")
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = nil
+		chirp.UpdatedAt = &now
+		return tx.PutChirp(chirp)
+	})
+	if err != nil {
+		return ChirpResource{}, err
+	}
+	return chirp, nil
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	author, _ := db.CreateUsers(ctx, "a@b.c", "h")
+	other, _ := db.CreateUsers(ctx, "d@e.f", "h")
+	c, _ := db.CreateChirp(ctx, "hi", author.ID)
+
+	if err := db.DeleteChirp(ctx, c.ID, author.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetChirp(c.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+	if chirps, _ := db.GetChirps(); len(chirps) != 0 {
+		t.Fatal(chirps)
+	}
+	if page, err := db.QueryChirps(NewQuery()); err != nil || len(page.Items) != 0 {
+		t.Fatal(page, err)
+	}
+	if trash, err := db.GetTrash(author.ID); err != nil || len(trash) != 1 || !trash[0].Trashed() {
+		t.Fatal(trash, err)
+	}
+	if trash, _ := db.GetTrash(other.ID); len(trash) != 0 {
+		t.Fatal(trash)
+	}
+
+	if _, err := db.RestoreChirp(ctx, c.ID, other.ID); !errors.Is(err, ErrForbidden) {
+		t.Fatal(err)
+	}
+	restored, err := db.RestoreChirp(ctx, c.ID, author.ID)
+	if err != nil || restored.Trashed() {
+		t.Fatal(restored, err)
+	}
+	if got, err := db.GetChirp(c.ID); err != nil || got.Body != "hi" {
+		t.Fatal(got, err)
+	}
+	if _, err := db.RestoreChirp(ctx, c.ID, author.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+	if _, err := db.RestoreChirp(ctx, 99, author.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,454 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Tx is a consistent view of the database for the duration of a View or
+// Update call. Changes made through a Tx are applied straight to the
+// in-memory data, and undone again if the Update callback returns an error.
+type Tx struct {
+	data     DBData
+	ix       *indexes
+	readOnly bool
+	records  []record
+	events   []Event
+	undo     []func()
+}
+
+// Update runs fn under an exclusive lock. If fn returns an error every change
+// it made is rolled back and the error is passed back to the caller,
+// otherwise the changes are queued to be flushed to the backend. Once fn
+// has succeeded the changes are committed, and a flush that fails after
+// that only leaves them pending for the next one to retry.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.UpdateContext(context.Background(), "Update", fn)
+}
+
+// UpdateContext is Update, but records the changes in the audit log as
+// action, made by the Actor set on ctx.
+func (db *DB) UpdateContext(ctx context.Context, action string, fn func(tx *Tx) error) error {
+	return db.update(ctx, action, "", fn)
+}
+
+// update is UpdateContext with a note added to the audit entry.
+func (db *DB) update(ctx context.Context, action string, note string, fn func(tx *Tx) error) error {
+	db.mux.Lock()
+
+	if db.closed {
+		db.mux.Unlock()
+		return ErrClosed
+	}
+	if err := db.writableBy(ctx); err != nil {
+		db.mux.Unlock()
+		return err
+	}
+	tx := &Tx{data: db.data, ix: db.ix}
+	now := time.Now().UTC()
+	err := fn(tx)
+	if err == nil {
+		err = tx.stampEvents(now)
+	}
+	if err == nil && len(tx.events) > 0 {
+		err = db.audit(ctx, action, note, tx.events, now)
+	}
+	if err != nil {
+		tx.rollback()
+		db.mux.Unlock()
+		return err
+	}
+	db.pending = append(db.pending, tx.records...)
+	db.pendingEvents = append(db.pendingEvents, tx.events...)
+	db.changes.append(tx.events)
+	shouldFlush := len(db.pending) >= db.opts.FlushEvery
+	db.mux.Unlock()
+
+	if shouldFlush {
+		// Readers and subscribers already see the change, so it can't be
+		// reported as failed any more
+		err = db.Flush()
+		if err != nil {
+			log.Printf("Error flushing database, changes stay pending %v", err)
+		}
+	}
+	return nil
+}
+
+// View runs fn with a read-only Tx. Any number of View calls can run at the
+// same time, but never alongside an Update.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: db.data, ix: db.ix, readOnly: true})
+}
+
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.records = nil
+	tx.events = nil
+}
+
+func (tx *Tx) writable() error {
+	if tx.readOnly {
+		return ErrReadOnlyTx
+	}
+	return nil
+}
+
+func (tx *Tx) Chirp(id int) (ChirpResource, bool) {
+	chirp, ok := tx.data.Chirps[id]
+	return chirp, ok
+}
+
+func (tx *Tx) Chirps() []ChirpResource {
+	var chirps []ChirpResource
+	for _, chirp := range tx.data.Chirps {
+		chirps = append(chirps, chirp)
+	}
+	return chirps
+}
+
+// ChirpsByAuthor returns every chirp written by the given user.
+func (tx *Tx) ChirpsByAuthor(authorID int) []ChirpResource {
+	var chirps []ChirpResource
+	for id := range tx.ix.chirpsByAuthor[authorID] {
+		chirps = append(chirps, tx.data.Chirps[id])
+	}
+	return chirps
+}
+
+func (tx *Tx) ChirpByPublicID(publicID string) (ChirpResource, bool) {
+	id, ok := tx.ix.chirpByPublicID[publicID]
+	if !ok {
+		return ChirpResource{}, false
+	}
+	return tx.Chirp(id)
+}
+
+func (tx *Tx) NextChirpID() (int, error) {
+	return tx.nextID(entityChirp)
+}
+
+func (tx *Tx) PutChirp(chirp ChirpResource) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	rec, err := newPutRecord(entityChirp, strconv.Itoa(chirp.ID), chirp)
+	if err != nil {
+		return err
+	}
+	prev, existed := tx.data.Chirps[chirp.ID]
+	err = tx.change(rec, prev, existed)
+	if err != nil {
+		return err
+	}
+	tx.setChirp(chirp.ID, chirp, true)
+	tx.undo = append(tx.undo, func() {
+		tx.setChirp(chirp.ID, prev, existed)
+	})
+	return nil
+}
+
+func (tx *Tx) DeleteChirp(id int) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	prev, existed := tx.data.Chirps[id]
+	if !existed {
+		return nil
+	}
+	err := tx.change(newDeleteRecord(entityChirp, strconv.Itoa(id)), prev, true)
+	if err != nil {
+		return err
+	}
+	tx.setChirp(id, ChirpResource{}, false)
+	tx.undo = append(tx.undo, func() {
+		tx.setChirp(id, prev, true)
+	})
+	return nil
+}
+
+// setChirp stores chirp under id, or removes whatever is stored under id if
+// present is false, keeping the indexes in step either way.
+func (tx *Tx) setChirp(id int, chirp ChirpResource, present bool) {
+	if old, ok := tx.data.Chirps[id]; ok {
+		tx.ix.removeChirp(old)
+	}
+	if !present {
+		delete(tx.data.Chirps, id)
+		return
+	}
+	tx.data.Chirps[id] = chirp
+	tx.ix.addChirp(chirp)
+}
+
+func (tx *Tx) User(id int) (DetailedUserResource, bool) {
+	user, ok := tx.data.Users[id]
+	return user, ok
+}
+
+func (tx *Tx) Users() []DetailedUserResource {
+	var users []DetailedUserResource
+	for _, user := range tx.data.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (tx *Tx) UserByEmail(email string) (DetailedUserResource, bool) {
+	id, ok := tx.ix.userByEmail[emailKey(email)]
+	if !ok {
+		return DetailedUserResource{}, false
+	}
+	return tx.User(id)
+}
+
+func (tx *Tx) NextUserID() (int, error) {
+	return tx.nextID(entityUser)
+}
+
+// nextID bumps and returns the sequence for entity.
+func (tx *Tx) nextID(entity string) (int, error) {
+	id := tx.data.Sequences[entity] + 1
+	err := tx.setSequence(entity, id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (tx *Tx) setSequence(entity string, value int) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	rec, err := newPutRecord(entitySequence, entity, value)
+	if err != nil {
+		return err
+	}
+	prev := tx.data.Sequences[entity]
+	tx.data.Sequences[entity] = value
+	tx.records = append(tx.records, rec)
+	tx.undo = append(tx.undo, func() {
+		tx.data.Sequences[entity] = prev
+	})
+	return nil
+}
+
+// PutUser stores user, failing with ErrEmailTaken if another user already
+// has the same email.
+func (tx *Tx) PutUser(user DetailedUserResource) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	if other, ok := tx.UserByEmail(user.Email); ok && other.ID != user.ID {
+		return ErrEmailTaken
+	}
+	rec, err := newPutRecord(entityUser, strconv.Itoa(user.ID), user)
+	if err != nil {
+		return err
+	}
+	prev, existed := tx.data.Users[user.ID]
+	err = tx.change(rec, prev, existed)
+	if err != nil {
+		return err
+	}
+	tx.setUser(user.ID, user, true)
+	tx.undo = append(tx.undo, func() {
+		tx.setUser(user.ID, prev, existed)
+	})
+	return nil
+}
+
+// DeleteUser removes a user for good. Their chirps are left alone.
+func (tx *Tx) DeleteUser(id int) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	prev, existed := tx.data.Users[id]
+	if !existed {
+		return nil
+	}
+	err := tx.change(newDeleteRecord(entityUser, strconv.Itoa(id)), prev, true)
+	if err != nil {
+		return err
+	}
+	tx.setUser(id, DetailedUserResource{}, false)
+	tx.undo = append(tx.undo, func() {
+		tx.setUser(id, prev, true)
+	})
+	return nil
+}
+
+// setUser is the user counterpart of setChirp.
+func (tx *Tx) setUser(id int, user DetailedUserResource, present bool) {
+	if old, ok := tx.data.Users[id]; ok {
+		tx.ix.removeUser(old)
+	}
+	if !present {
+		delete(tx.data.Users, id)
+		return
+	}
+	tx.data.Users[id] = user
+	tx.ix.addUser(user)
+}
+
+func (tx *Tx) Revocation(hash string) (Revocation, bool) {
+	revocation, ok := tx.data.Revocations[hash]
+	return revocation, ok
+}
+
+func (tx *Tx) PutRevocation(hash string, revocation Revocation) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	rec, err := newPutRecord(entityRevocation, hash, revocation)
+	if err != nil {
+		return err
+	}
+	prev, existed := tx.data.Revocations[hash]
+	err = tx.change(rec, prev, existed)
+	if err != nil {
+		return err
+	}
+	tx.data.Revocations[hash] = revocation
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.data.Revocations[hash] = prev
+			return
+		}
+		delete(tx.data.Revocations, hash)
+	})
+	return nil
+}
+
+func (tx *Tx) DeleteRevocation(hash string) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	prev, existed := tx.data.Revocations[hash]
+	if !existed {
+		return nil
+	}
+	err := tx.change(newDeleteRecord(entityRevocation, hash), prev, true)
+	if err != nil {
+		return err
+	}
+	delete(tx.data.Revocations, hash)
+	tx.undo = append(tx.undo, func() {
+		tx.data.Revocations[hash] = prev
+	})
+	return nil
+}
+
+func (tx *Tx) Hold(entity string, id int) (LegalHold, bool) {
+	hold, ok := tx.data.Holds[holdKey(entity, id)]
+	return hold, ok
+}
+
+func (tx *Tx) Holds() []LegalHold {
+	var holds []LegalHold
+	for _, hold := range tx.data.Holds {
+		holds = append(holds, hold)
+	}
+	return holds
+}
+
+func (tx *Tx) PutHold(hold LegalHold) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	key := holdKey(hold.Entity, hold.ID)
+	rec, err := newPutRecord(entityHold, key, hold)
+	if err != nil {
+		return err
+	}
+	prev, existed := tx.data.Holds[key]
+	err = tx.change(rec, prev, existed)
+	if err != nil {
+		return err
+	}
+	tx.data.Holds[key] = hold
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.data.Holds[key] = prev
+			return
+		}
+		delete(tx.data.Holds, key)
+	})
+	return nil
+}
+
+func (tx *Tx) DeleteHold(entity string, id int) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	key := holdKey(entity, id)
+	prev, existed := tx.data.Holds[key]
+	if !existed {
+		return nil
+	}
+	err := tx.change(newDeleteRecord(entityHold, key), prev, true)
+	if err != nil {
+		return err
+	}
+	delete(tx.data.Holds, key)
+	tx.undo = append(tx.undo, func() {
+		tx.data.Holds[key] = prev
+	})
+	return nil
+}
+
+// Revisions returns the earlier bodies of the given chirp, oldest first.
+func (tx *Tx) Revisions(chirpID int) []ChirpRevision {
+	return tx.data.Revisions[chirpID].Revisions
+}
+
+func (tx *Tx) PutRevisions(history ChirpHistory) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	rec, err := newPutRecord(entityRevision, strconv.Itoa(history.ChirpID), history)
+	if err != nil {
+		return err
+	}
+	prev, existed := tx.data.Revisions[history.ChirpID]
+	err = tx.change(rec, prev, existed)
+	if err != nil {
+		return err
+	}
+	tx.data.Revisions[history.ChirpID] = history
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.data.Revisions[history.ChirpID] = prev
+			return
+		}
+		delete(tx.data.Revisions, history.ChirpID)
+	})
+	return nil
+}
+
+func (tx *Tx) DeleteRevisions(chirpID int) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+	prev, existed := tx.data.Revisions[chirpID]
+	if !existed {
+		return nil
+	}
+	err := tx.change(newDeleteRecord(entityRevision, strconv.Itoa(chirpID)), prev, true)
+	if err != nil {
+		return err
+	}
+	delete(tx.data.Revisions, chirpID)
+	tx.undo = append(tx.undo, func() {
+		tx.data.Revisions[chirpID] = prev
+	})
+	return nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRollback(t *testing.T) {
+	db := NewMemoryDB(Options{})
+	defer db.Close()
+	db.CreateUsers(ctx, "a@b.c", "x")
+	db.CreateChirp(ctx, "x", 1)
+	err := db.Update(func(tx *Tx) error {
+		tx.PutChirp(ChirpResource{ID: 1, Body: "changed"})
+		tx.PutChirp(ChirpResource{ID: 2, Body: "new"})
+		tx.DeleteChirp(1)
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	chirps, _ := db.GetChirps()
+	if len(chirps) != 1 || chirps[0].Body != "x" {
+		t.Fatal(chirps)
+	}
+	if db.LastChangeSeq() != 2 {
+		t.Fatal(db.LastChangeSeq())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	opts := Options{FlushEvery: 10, FlushInterval: 50 * time.Millisecond}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "x")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.CreateChirp(ctx, "hello", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	db.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	chirps, _ := db.GetChirps()
+	users, _ := db.GetUsers()
+	if len(chirps) != 50 || len(users) != 1 {
+		t.Fatalf("got %d chirps %d users", len(chirps), len(users))
+	}
+}
+
+// failingBackend keeps everything in memory, but fails to write while fail
+// is set.
+type failingBackend struct {
+	memoryBackend
+	fail bool
+}
+
+func (b *failingBackend) write(dbData DBData, records []record) error {
+	if b.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestFailedFlushKeepsChanges(t *testing.T) {
+	store := &failingBackend{fail: true}
+	db, err := openDB(store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	u, err := db.CreateUsers(ctx, "a@b.c", "x")
+	if err != nil {
+		t.Fatal("committed change reported as failed:", err)
+	}
+	if _, err := db.GetUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.pending) == 0 {
+		t.Fatal("changes were dropped")
+	}
+	if db.FlushError() == nil {
+		t.Fatal("failed flush not reported")
+	}
+	if err := db.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	store.fail = false
+	if err := db.Flush(); err != nil || len(db.pending) != 0 {
+		t.Fatal(db.pending, err)
+	}
+	if err := db.FlushError(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes that still can't be written out when closing fail Close
+	store.fail = true
+	db.CreateChirp(ctx, "hi", u.ID)
+	if err := db.Close(); err == nil {
+		t.Fatal("pending changes dropped silently on close")
+	}
+}
+
+func TestSequences(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	opts := Options{PublicIDs: true}
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "x")
+	db.CreateChirp(ctx, "a", 1)
+	c2, _ := db.CreateChirp(ctx, "b", 1)
+	// Purge the newest chirp for good, rather than moving it to the trash
+	err = db.Update(func(tx *Tx) error {
+		return tx.DeleteChirp(c2.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c3, _ := db.CreateChirp(ctx, "c", 1)
+	if c3.ID != 3 {
+		t.Fatal(c3)
+	}
+	if !(c2.PublicID < c3.PublicID) || len(c3.PublicID) != 26 {
+		t.Fatal(c2.PublicID, c3.PublicID)
+	}
+	got, err := db.GetChirpByPublicID(c3.PublicID)
+	if err != nil || got.ID != 3 {
+		t.Fatal(got, err)
+	}
+}
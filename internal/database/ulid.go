@@ -0,0 +1,74 @@
+package database
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator hands out ULID-style IDs: 26 characters made of a 48 bit
+// millisecond timestamp followed by 80 random bits. IDs sort by creation
+// time, and IDs made within the same millisecond still sort in the order
+// they were handed out.
+type ulidGenerator struct {
+	mux     sync.Mutex
+	lastMs  uint64
+	lastRnd [10]byte
+}
+
+var publicIDs = &ulidGenerator{}
+
+func (g *ulidGenerator) next(now time.Time) (string, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		incrementBytes(g.lastRnd[:])
+	} else {
+		_, err := rand.Read(g.lastRnd[:])
+		if err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var raw [16]byte
+	for i := 0; i < 6; i++ {
+		raw[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(raw[6:], g.lastRnd[:])
+	return encodeULID(raw), nil
+}
+
+func incrementBytes(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// encodeULID writes the 128 bits in raw as 26 base32 characters. The first
+// character only carries the top 3 bits, so the first 2 bits are zero padding.
+func encodeULID(raw [16]byte) string {
+	out := make([]byte, 26)
+	var acc uint32
+	bits := 2
+	pos := 0
+	for _, b := range raw {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out)
+}
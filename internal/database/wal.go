@@ -0,0 +1,270 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+const (
+	entityChirp        = "chirp"
+	entityUser         = "user"
+	entityRevokedToken = "revoked_token"
+	entityRevocation   = "revocation"
+	entityHold         = "hold"
+	entityRevision     = "revision"
+	entitySequence     = "sequence"
+)
+
+// record is a single mutation as it is written to the write-ahead log.
+type record struct {
+	Op     string          `json:"op"`
+	Entity string          `json:"entity"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+func newPutRecord(entity, key string, value interface{}) (record, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return record{}, err
+	}
+	return record{Op: opPut, Entity: entity, Key: key, Value: data}, nil
+}
+
+func newDeleteRecord(entity, key string) record {
+	return record{Op: opDelete, Entity: entity, Key: key}
+}
+
+// apply replays rec on top of dbData.
+func (rec record) apply(dbData *DBData) error {
+	switch rec.Entity {
+	case entityChirp:
+		id, err := strconv.Atoi(rec.Key)
+		if err != nil {
+			return err
+		}
+		if rec.Op == opDelete {
+			delete(dbData.Chirps, id)
+			return nil
+		}
+		chirp := ChirpResource{}
+		err = json.Unmarshal(rec.Value, &chirp)
+		if err != nil {
+			return err
+		}
+		dbData.Chirps[id] = chirp
+	case entityUser:
+		id, err := strconv.Atoi(rec.Key)
+		if err != nil {
+			return err
+		}
+		if rec.Op == opDelete {
+			delete(dbData.Users, id)
+			return nil
+		}
+		user := DetailedUserResource{}
+		err = json.Unmarshal(rec.Value, &user)
+		if err != nil {
+			return err
+		}
+		dbData.Users[id] = user
+	case entityRevokedToken:
+		// Only found in logs written before schema version 2
+		if rec.Op == opDelete {
+			delete(dbData.RevokedTokens, rec.Key)
+			return nil
+		}
+		var revokedAt int64
+		err := json.Unmarshal(rec.Value, &revokedAt)
+		if err != nil {
+			return err
+		}
+		dbData.RevokedTokens[rec.Key] = revokedAt
+	case entityRevocation:
+		if rec.Op == opDelete {
+			delete(dbData.Revocations, rec.Key)
+			return nil
+		}
+		revocation := Revocation{}
+		err := json.Unmarshal(rec.Value, &revocation)
+		if err != nil {
+			return err
+		}
+		dbData.Revocations[rec.Key] = revocation
+	case entityHold:
+		if rec.Op == opDelete {
+			delete(dbData.Holds, rec.Key)
+			return nil
+		}
+		hold := LegalHold{}
+		err := json.Unmarshal(rec.Value, &hold)
+		if err != nil {
+			return err
+		}
+		dbData.Holds[rec.Key] = hold
+	case entityRevision:
+		id, err := strconv.Atoi(rec.Key)
+		if err != nil {
+			return err
+		}
+		if rec.Op == opDelete {
+			delete(dbData.Revisions, id)
+			return nil
+		}
+		history := ChirpHistory{}
+		err = json.Unmarshal(rec.Value, &history)
+		if err != nil {
+			return err
+		}
+		dbData.Revisions[id] = history
+	case entitySequence:
+		var id int
+		err := json.Unmarshal(rec.Value, &id)
+		if err != nil {
+			return err
+		}
+		dbData.Sequences[rec.Key] = id
+	default:
+		return errors.New(fmt.Sprintf("Unknown entity %v in log record", rec.Entity))
+	}
+	return nil
+}
+
+// encodeRecord turns rec into a single log line.
+func encodeRecord(rec record, s *sealer) ([]byte, error) {
+	return encodeLine(rec, s)
+}
+
+func decodeRecord(line []byte, s *sealer) (record, error) {
+	rec := record{}
+	err := decodeLine(line, s, &rec)
+	return rec, err
+}
+
+// encodeLine turns v into a single JSON line. Encrypted lines are the base64
+// encoded sealed JSON, so they never start with '{' like plain ones.
+func encodeLine(v interface{}, s *sealer) ([]byte, error) {
+	line, err := json.Marshal(v)
+	if err != nil || s == nil {
+		return line, err
+	}
+	sealed, err := s.seal(line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func decodeLine(line []byte, s *sealer, v interface{}) error {
+	if !bytes.HasPrefix(line, []byte("{")) {
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return err
+		}
+		line, err = s.open(sealed)
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(line, v)
+}
+
+// appendWAL writes records to the end of the log at path and syncs it.
+func appendWAL(path string, records []record, s *sealer) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := bytes.Buffer{}
+	for _, rec := range records {
+		line, err := encodeRecord(rec, s)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// replayWAL applies every record in the log at path to dbData and returns
+// how many were applied. A missing log is the same as an empty one. A
+// half-written last line, left behind by a crash during append, is ignored.
+func replayWAL(path string, dbData *DBData, s *sealer) (int, error) {
+	lines, err := readLogLines(path)
+	if err != nil {
+		return 0, err
+	}
+	for count, line := range lines {
+		rec, err := decodeRecord(line, s)
+		if errors.Is(err, ErrNoKey) || errors.Is(err, ErrWrongKey) {
+			return count, fmt.Errorf("%v: %w", path, err)
+		}
+		if err != nil {
+			return count, err
+		}
+		err = rec.apply(dbData)
+		if err != nil {
+			return count, err
+		}
+	}
+	return len(lines), nil
+}
+
+// readLogLines returns every line of the append-only log at path, leaving
+// out empty ones. A missing log has no lines. Anything after the last
+// newline is a line a crash cut off halfway through appending, and is left
+// out too.
+func readLogLines(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// repairLog cuts a half-written last line off the log at path, so the next
+// append starts on a line of its own instead of running on from it.
+func repairLog(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == len(data) {
+		return nil
+	}
+	log.Printf("Cutting a half-written line off the end of %v", path)
+	return os.Truncate(path, int64(end))
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+// writeChirps appends a log record for each chirp, the way a flush does,
+// without ever closing the backend cleanly.
+func writeChirps(t *testing.T, b *jsonFileBackend, dbData DBData, from, to int) {
+	t.Helper()
+	for id := from; id <= to; id++ {
+		chirp := ChirpResource{ID: id, Body: "chirp " + strconv.Itoa(id), AuthorID: 1}
+		dbData.Chirps[id] = chirp
+		rec, err := newPutRecord(entityChirp, strconv.Itoa(id), chirp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.write(dbData, []record{rec})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	b, err := newJSONFileBackend(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChirps(t, b, emptyDBData(), 1, 3)
+	b.close()
+
+	// Cut the last record off halfway through, as a crash during append would
+	wal, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".wal", wal[:len(wal)-20], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if chirp, err := db.GetChirp(2); err != nil || chirp.Body != "chirp 2" {
+		t.Fatal(chirp, err)
+	}
+	if chirp, err := db.GetChirp(3); err == nil {
+		t.Fatal("torn record was replayed", chirp)
+	}
+	// The replayed records were folded into db.json on startup
+	if info, err := os.Stat(path + ".wal"); err != nil || info.Size() != 0 {
+		t.Fatal(info, err)
+	}
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	b, err := newJSONFileBackend(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChirps(t, b, emptyDBData(), 1, 1)
+	b.close()
+
+	// Only a torn last line is forgiven, not a whole line that can't be read
+	f, err := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"op\":\"put\",\"ent\n")
+	f.Close()
+
+	if _, err := NewDB(path, Options{}); err == nil {
+		t.Fatal("opened a database with a corrupt log")
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	b, err := newJSONFileBackend(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	dbData := emptyDBData()
+	writeChirps(t, b, dbData, 1, walCompactThreshold-1)
+	if info, err := os.Stat(path + ".wal"); err != nil || info.Size() == 0 {
+		t.Fatal("log was compacted early", err)
+	}
+
+	writeChirps(t, b, dbData, walCompactThreshold, walCompactThreshold)
+	if info, err := os.Stat(path + ".wal"); err != nil || info.Size() != 0 {
+		t.Fatal(info, err)
+	}
+	snapshot, _, err := readSnapshot(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Chirps) != walCompactThreshold {
+		t.Fatal(len(snapshot.Chirps))
+	}
+}
+
+func TestWALAppendAfterTornRecord(t *testing.T) {
+	path := t.TempDir() + "/db.json"
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUsers(ctx, "a@b.c", "x")
+	db.Close()
+	// Fold the user into db.json, so the log only holds the torn record
+	db, _ = NewDB(path, Options{})
+	db.Close()
+	err = os.WriteFile(path+".wal", []byte(`{"op":"put","entity":"chirp","key":"1","val`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp(ctx, "after the crash", 1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if chirp, err := db.GetChirp(1); err != nil || chirp.Body != "after the crash" {
+		t.Fatal(chirp, err)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/AtinAgnihotri/chirpy/internal/database"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/joho/godotenv"
 )
 
@@ -15,6 +22,8 @@ type ApiConfig struct {
 	fileServerHits int
 	JWTSecret      string
 	PolkaApiKey    string
+	AdminApiKey    string
+	follower       *follower
 }
 
 func (cfg *ApiConfig) middlewareMetricsIncrement(next http.Handler) http.Handler {
@@ -27,7 +36,7 @@ func (cfg *ApiConfig) middlewareMetricsIncrement(next http.Handler) http.Handler
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -37,37 +46,171 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func isDebugMode() bool {
+type serverFlags struct {
+	debug           bool
+	inMemory        bool
+	flushInterval   time.Duration
+	flushEvery      int
+	backups         int
+	recover         bool
+	publicIDs       bool
+	migrateDryRun   bool
+	pruneInterval   time.Duration
+	retention       []database.RetentionRule
+	retentionDryRun bool
+	lockTimeout     time.Duration
+	changeLogSize   int
+	editWindow      time.Duration
+	dbPath          string
+	port            string
+	follow          string
+}
+
+func parseFlags() serverFlags {
 	dbg := flag.Bool("debug", false, "Enable debug mode in server")
+	inMemory := flag.Bool("in-memory", false, "Keep all data in memory instead of db.json")
+	flushInterval := flag.Duration("flush-interval", time.Second, "How often pending changes are written to disk")
+	flushEvery := flag.Int("flush-every", 100, "Write to disk as soon as this many changes are pending")
+	backups := flag.Int("backups", 3, "How many snapshots of db.json to keep as backups")
+	recoverBackup := flag.Bool("recover", false, "Restore db.json from the newest valid backup if it is corrupt")
+	publicIDs := flag.Bool("public-ids", false, "Give new chirps and users an opaque, sortable public_id")
+	pruneInterval := flag.Duration("prune-interval", time.Hour, "How often the retention rules are applied")
+	retention := flag.String("retention", "", "Retention rules to change from the defaults, e.g. chirps=365d,trash=7d or deleted-users=off")
+	retentionDryRun := flag.Bool("retention-dry-run", false, "Only log what the retention rules would purge")
+	lockTimeout := flag.Duration("lock-timeout", 0, "How long to wait for another process using db.json to exit")
+	changeLogSize := flag.Int("change-log-size", 10000, "How many of the newest change events are kept for consumers to catch up on")
+	editWindow := flag.Duration("edit-window", 15*time.Minute, "How long after posting a chirp its author can edit it, 0 to disable editing")
+	dbPath := flag.String("db", "./db.json", "Path of the database file")
+	port := flag.String("port", "8080", "Port to serve on")
+	follow := flag.String("follow", "", "URL of a leader to replicate from, making this server a read-only follower")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "List the database migrations that would run on db.json, then exit")
 	flag.Parse()
-	return *dbg
+	retentionRules, err := database.ParseRetentionRules(*retention)
+	if err != nil {
+		log.Fatal("Error reading --retention ", err)
+	}
+	return serverFlags{
+		debug:           *dbg,
+		inMemory:        *inMemory,
+		flushInterval:   *flushInterval,
+		flushEvery:      *flushEvery,
+		backups:         *backups,
+		recover:         *recoverBackup,
+		publicIDs:       *publicIDs,
+		migrateDryRun:   *migrateDryRun,
+		pruneInterval:   *pruneInterval,
+		retention:       retentionRules,
+		retentionDryRun: *retentionDryRun,
+		lockTimeout:     *lockTimeout,
+		changeLogSize:   *changeLogSize,
+		editWindow:      *editWindow,
+		dbPath:          *dbPath,
+		port:            *port,
+		follow:          *follow,
+	}
+}
+
+func dbOptions(flags serverFlags, encryptionKey []byte) database.Options {
+	return database.Options{
+		Debug:             flags.debug,
+		FlushInterval:     flags.flushInterval,
+		FlushEvery:        flags.flushEvery,
+		Backups:           flags.backups,
+		RecoverFromBackup: flags.recover,
+		PublicIDs:         flags.publicIDs,
+		PruneInterval:     flags.pruneInterval,
+		Retention:         flags.retention,
+		RetentionDryRun:   flags.retentionDryRun,
+		LockTimeout:       flags.lockTimeout,
+		EncryptionKey:     encryptionKey,
+		ChangeLogSize:     flags.changeLogSize,
+		EditWindow:        flags.editWindow,
+	}
+}
+
+func openStore(flags serverFlags, encryptionKey []byte) (database.Store, error) {
+	opts := dbOptions(flags, encryptionKey)
+	if flags.inMemory {
+		return database.NewMemoryDB(opts), nil
+	}
+	return database.NewDB(flags.dbPath, opts)
+}
+
+func dryRunMigrations(flags serverFlags, encryptionKey []byte) {
+	pending, err := database.DryRunMigrations(flags.dbPath, encryptionKey)
+	var locked *database.LockedError
+	if errors.As(err, &locked) {
+		log.Printf("%v, which migrated it when it started", err)
+		return
+	}
+	if err != nil {
+		log.Fatal("Migration dry run failed ", err)
+	}
+	if len(pending) == 0 {
+		log.Printf("Database is at schema version %v, nothing to migrate", database.SchemaVersion())
+		return
+	}
+	for _, m := range pending {
+		log.Printf("Would apply migration %v: %v", m.Version, m.Name)
+	}
 }
 
 func main() {
+	flags := parseFlags()
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	encryptionKey, err := database.ParseEncryptionKey(os.Getenv("DB_ENCRYPTION_KEY"))
+	if err != nil {
+		log.Fatal("Error reading DB_ENCRYPTION_KEY ", err)
+	}
+
+	if flags.migrateDryRun {
+		dryRunMigrations(flags, encryptionKey)
+		return
+	}
+	if flag.NArg() > 0 {
+		err = runCommand(flag.Args(), flags, encryptionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	cfg := ApiConfig{
 		JWTSecret:   os.Getenv("JWT_SECRET"),
 		PolkaApiKey: os.Getenv("POLKA_KEY"),
+		AdminApiKey: os.Getenv("ADMIN_API_KEY"),
 	}
-	db, err := database.NewDB("./db.json", isDebugMode())
+	db, err := openStore(flags, encryptionKey)
 
 	if err != nil {
 		log.Fatal("Error setting up db", err)
 	}
+	if flags.follow != "" {
+		// A follower logs in to its leader as an admin
+		leaderKey := os.Getenv("LEADER_API_KEY")
+		if leaderKey == "" {
+			leaderKey = cfg.AdminApiKey
+		}
+		cfg.follower = startFollower(flags.follow, leaderKey, db)
+		log.Printf("Following leader %v", flags.follow)
+	}
+
 	// mux := http.NewServeMux()
-	port := "8080"
+	port := flags.port
 	fileDir := http.Dir(".")
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
 
 	// Mount /api namespace
 	r.Mount("/api", ApiHandler(&cfg, db))
 
 	// Mount /admin namespace
-	r.Mount("/admin", AdminHandler(&cfg))
+	r.Mount("/admin", AdminHandler(&cfg, db))
 
 	// fileserver endpoint
 	fsHandler := cfg.middlewareMetricsIncrement(http.StripPrefix("/app", http.FileServer(fileDir)))
@@ -76,12 +219,41 @@ func main() {
 
 	corsMux := corsMiddleware(r)
 
+	// Long lived requests, like followers streaming changes, are cancelled
+	// on shutdown rather than waited for
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMux,
+		Addr:        ":" + port,
+		Handler:     corsMux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
+	srv.RegisterOnShutdown(cancelBase)
+
+	go func() {
+		log.Printf("Serving files from %s on port: %s\n", fileDir, port)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Printf("Serving files from %s on port: %s\n", fileDir, port)
-	log.Fatal(srv.ListenAndServe())
+	// Wait for a shutdown signal so pending database changes get flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
 
+	log.Printf("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error shutting down server %v", err)
+	}
+	if cfg.follower != nil {
+		cfg.follower.stop()
+	}
+	err = db.Close()
+	if err != nil {
+		log.Fatal("Error closing db", err)
+	}
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+)
+
+// replicationHeartbeat is how often a leader tells its followers how far
+// along it is while there are no changes to send. A follower that hears
+// nothing for three heartbeats reconnects.
+const replicationHeartbeat = 5 * time.Second
+
+// replicationContext attributes changes a follower replicates from its
+// leader to replication in the audit log.
+var replicationContext = database.WithActor(context.Background(), database.Actor{Name: "replication"})
+
+// errResync means a follower can't catch up from the leader's change events
+// and has to start over from a snapshot.
+var errResync = errors.New("leader no longer has the changes this follower needs")
+
+// ReplicationMessage is one line of the change stream a leader serves its
+// followers: a change event, or just a heartbeat telling how far along the
+// leader is.
+type ReplicationMessage struct {
+	Event     *database.Event `json:"event,omitempty"`
+	LeaderSeq int             `json:"leader_seq"`
+	Time      time.Time       `json:"time"`
+}
+
+// ReplicationStatus tells how far a follower is behind its leader. A leader
+// only reports its role and the last change it made, the other fields are
+// left empty.
+type ReplicationStatus struct {
+	Role       string `json:"role"`
+	Leader     string `json:"leader,omitempty"`
+	Connected  bool   `json:"connected"`
+	AppliedSeq int    `json:"applied_seq"`
+	LeaderSeq  int    `json:"leader_seq,omitempty"`
+	// LagEvents is how many changes the follower has yet to apply, as of
+	// the last it heard from the leader.
+	LagEvents int `json:"lag_events"`
+	// LagSeconds is how long ago the follower was last caught up.
+	LagSeconds  float64    `json:"lag_seconds"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// follower keeps db in step with the leader at the given URL, until it is
+// promoted.
+type follower struct {
+	leader string
+	apiKey string
+	db     database.Store
+	client *http.Client
+
+	mux        *sync.Mutex
+	status     ReplicationStatus
+	caughtUpAt time.Time
+	promoted   bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// startFollower turns db into a read-only follower of leader and starts
+// replicating from it. apiKey is the leader's ADMIN_API_KEY.
+func startFollower(leader string, apiKey string, db database.Store) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		leader:     strings.TrimSuffix(leader, "/"),
+		apiKey:     apiKey,
+		db:         db,
+		client:     &http.Client{},
+		mux:        &sync.Mutex{},
+		status:     ReplicationStatus{Role: "follower", Leader: leader},
+		caughtUpAt: time.Now(),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	db.SetFollower(true)
+	go f.run(ctx)
+	return f
+}
+
+// run follows the leader, reconnecting whenever the connection is lost and
+// resyncing from a snapshot when it has to, until stopped. It always starts
+// from a snapshot, since the data on disk may have changes of its own, or
+// come from another leader, under the same sequence numbers.
+func (f *follower) run(ctx context.Context) {
+	defer close(f.done)
+
+	resync := true
+	for {
+		var err error
+		if resync {
+			err = f.resync(ctx)
+		}
+		if err == nil {
+			err = f.follow(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		resync = errors.Is(err, errResync) || errors.Is(err, database.ErrOutOfSync)
+		log.Printf("Error following leader %v %v", f.leader, err)
+		f.disconnected(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (f *follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "ApiKey "+f.apiKey)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusBadRequest {
+		return nil, fmt.Errorf("%w: %v", errResync, strings.TrimSpace(string(body)))
+	}
+	return nil, fmt.Errorf("leader responded with %v: %v", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// resync replaces all of the data with a snapshot from the leader.
+func (f *follower) resync(ctx context.Context) error {
+	log.Printf("Resyncing from leader %v", f.leader)
+	resp, err := f.get(ctx, "/admin/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	err = f.db.LoadReplicationSnapshot(replicationContext, raw)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resynced from leader %v at change %v", f.leader, f.db.LastChangeSeq())
+	return nil
+}
+
+// follow applies the changes the leader streams, until the connection is
+// lost or a change can't be applied.
+func (f *follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Give up on a leader that went quiet without closing the connection
+	silence := time.AfterFunc(3*replicationHeartbeat, cancel)
+	defer silence.Stop()
+
+	resp, err := f.get(ctx, fmt.Sprintf("/admin/replication/changes?after=%d", f.db.LastChangeSeq()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil && err != io.EOF {
+				return errors.New("no heartbeat from leader")
+			}
+			return err
+		}
+		silence.Reset(3 * replicationHeartbeat)
+		msg := ReplicationMessage{}
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			return err
+		}
+		if msg.Event != nil {
+			err = f.db.ApplyChanges(replicationContext, []database.Event{*msg.Event})
+			if err != nil {
+				return err
+			}
+		}
+		f.heardFrom(msg)
+	}
+}
+
+// heardFrom updates the status with a message from the leader.
+func (f *follower) heardFrom(msg ReplicationMessage) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	now := time.Now().UTC()
+	f.status.Connected = true
+	f.status.LastContact = &now
+	f.status.LastError = ""
+	f.status.LeaderSeq = msg.LeaderSeq
+	if f.db.LastChangeSeq() >= msg.LeaderSeq {
+		f.caughtUpAt = now
+	}
+}
+
+func (f *follower) disconnected(err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.status.Connected = false
+	f.status.LastError = err.Error()
+}
+
+// Status reports how far behind the leader the follower is.
+func (f *follower) Status() ReplicationStatus {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status := f.status
+	status.AppliedSeq = f.db.LastChangeSeq()
+	if f.promoted {
+		return ReplicationStatus{Role: "leader", AppliedSeq: status.AppliedSeq}
+	}
+	status.LagEvents = max(status.LeaderSeq-status.AppliedSeq, 0)
+	if status.LagEvents > 0 || !status.Connected {
+		status.LagSeconds = time.Since(f.caughtUpAt).Seconds()
+	}
+	return status
+}
+
+// stop stops replicating and waits for the change being applied, if any.
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+// promote stops replicating and makes the database writable, turning this
+// server into a leader. It fails if the server already is one.
+func (f *follower) promote() error {
+	f.mux.Lock()
+	promoted := f.promoted
+	f.promoted = true
+	f.mux.Unlock()
+	if promoted {
+		return errors.New("Already promoted to leader")
+	}
+	f.stop()
+	f.db.SetFollower(false)
+	return nil
+}
+
+// streamChanges serves the change events after the given sequence number to
+// a follower as NDJSON, with a heartbeat whenever there were none for a
+// while, until the follower hangs up or the server shuts down.
+func streamChanges(w http.ResponseWriter, r *http.Request, db database.Store, after int) {
+	sub, err := db.Subscribe(after)
+	if err != nil {
+		RespondWithDBError(w, err)
+		return
+	}
+	defer sub.Close()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		RespondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	send := func(event *database.Event) error {
+		err := enc.Encode(ReplicationMessage{Event: event, LeaderSeq: db.LastChangeSeq(), Time: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	err = send(nil)
+	for err == nil {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				log.Printf("Change stream to follower ended %v", sub.Err())
+				return
+			}
+			err = send(&event)
+			heartbeat.Reset(replicationHeartbeat)
+		case <-heartbeat.C:
+			err = send(nil)
+		case <-r.Context().Done():
+			return
+		}
+	}
+	log.Printf("Error streaming changes to follower %v", err)
+}
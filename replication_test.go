@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AtinAgnihotri/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestFollowerReplacesItsOwnHistory(t *testing.T) {
+	ctx := context.Background()
+	leader := database.NewMemoryDB(database.Options{})
+	defer leader.Close()
+	u, _ := leader.CreateUsers(ctx, "leader@b.c", "x")
+	leader.CreateChirp(ctx, "from the leader", u.ID)
+
+	// Same number of changes as the leader, but different ones
+	db := database.NewMemoryDB(database.Options{})
+	defer db.Close()
+	u, _ = db.CreateUsers(ctx, "follower@b.c", "x")
+	db.CreateChirp(ctx, "from the follower", u.ID)
+
+	r := chi.NewRouter()
+	r.Mount("/admin", AdminHandler(&ApiConfig{AdminApiKey: "key"}, leader))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	f := startFollower(server.URL, "key", db)
+	defer f.stop()
+	leader.CreateChirp(ctx, "after following", 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.LastChangeSeq() != leader.LastChangeSeq() {
+		if time.Now().After(deadline) {
+			t.Fatal(f.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := db.GetUserByEmail("follower@b.c"); err == nil {
+		t.Fatal("follower kept its own data")
+	}
+	chirps, _ := db.GetChirpsByAuthor(1)
+	if len(chirps) != 2 {
+		t.Fatal(chirps)
+	}
+	for _, chirp := range chirps {
+		if chirp.Body == "from the follower" {
+			t.Fatal(chirps)
+		}
+	}
+}
@@ -2,4 +2,4 @@
 go build -o out;
 
 # run that shiz
-./out $1
\ No newline at end of file
+./out "$@"
\ No newline at end of file